@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/spf13/pflag"
+	"github.com/taurusxin/fastsync/pkg/auth"
 	"github.com/taurusxin/fastsync/pkg/client"
 	"github.com/taurusxin/fastsync/pkg/config"
 	"github.com/taurusxin/fastsync/pkg/daemon"
 	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	"github.com/taurusxin/fastsync/pkg/utils"
+	"golang.org/x/term"
 )
 
 func main() {
@@ -58,9 +64,39 @@ func main() {
 	clientFlags.BoolVarP(&opts.Delete, "delete", "d", false, "Delete extraneous files from target")
 	clientFlags.BoolVarP(&opts.Overwrite, "overwrite", "o", false, "Overwrite existing files")
 	clientFlags.BoolVarP(&opts.Checksum, "checksum", "s", false, "Checksum check")
-	clientFlags.BoolVarP(&opts.Compress, "compress", "z", false, "Compress file data during the transfer")
-	clientFlags.BoolVarP(&opts.Archive, "archive", "a", false, "Archive mode")
+	clientFlags.StringVarP(&opts.Compress, "compress", "z", "", "Compress the transfer with zstd, lz4 or zlib, optionally with a level (zstd:3)")
+	clientFlags.Lookup("compress").NoOptDefVal = protocol.CompressZstd
+	var skipCompress string
+	clientFlags.StringVar(&skipCompress, "skip-compress", "", "Comma separated extensions sent uncompressed in addition to the built-in media and archive list (with -z)")
+	clientFlags.BoolVarP(&opts.Archive, "archive", "a", false, "Archive mode, accepted for compatibility only: times and permissions are now always preserved, not just with -a")
 	clientFlags.BoolVarP(&opts.Verbose, "verbose", "v", false, "Verbose output")
+	clientFlags.BoolVar(&opts.SizeOnly, "size-only", false, "Skip files that match in size, ignoring modification time")
+	clientFlags.BoolVarP(&opts.IgnoreTimes, "ignore-times", "I", false, "Don't skip files that match size and time")
+	clientFlags.BoolVar(&opts.Delta, "delta", false, "Only transfer the changed blocks of modified files")
+	clientFlags.BoolVar(&opts.Inplace, "inplace", false, "Update destination files in place instead of replacing them")
+	clientFlags.BoolVar(&opts.JSONFileList, "json-filelist", false, "Receive the remote file list as JSON instead of the binary encoding (debugging)")
+	clientFlags.IntVar(&opts.Streams, "streams", 4, "Number of files transferred concurrently over the daemon connection")
+	clientFlags.IntVar(&opts.Workers, "workers", 4, "Number of files copied concurrently when both paths are local")
+	clientFlags.StringVar(&opts.Reflink, "reflink", client.ReflinkNever, "Share data blocks of local copies on Btrfs/XFS (auto, always, never)")
+	clientFlags.Lookup("reflink").NoOptDefVal = client.ReflinkAuto
+	clientFlags.IntVar(&opts.Parallel, "parallel", 1, "Number of connections a large file is transferred over in chunks")
+	var chunkSize string
+	clientFlags.StringVar(&chunkSize, "chunk-size", "64M", "Chunk size of parallel transfers, larger files are split (with --parallel)")
+	clientFlags.StringVar(&opts.BwLimit, "bwlimit", "", "Limit the bandwidth to the daemon in bytes per second (1M), optionally by time of day (1M,08:00-18:00=256K)")
+	clientFlags.Int64Var(&opts.ModifyWindow, "modify-window", 0, "Allowed modification time difference in seconds")
+	clientFlags.IntVar(&opts.Timeout, "timeout", 0, "Give up when the daemon sent nothing for this many seconds (0 for no limit)")
+	clientFlags.IntVar(&opts.ConTimeout, "contimeout", 0, "Seconds to connect and authenticate to the daemon (0 for the system default)")
+
+	clientFlags.BoolVar(&opts.TLS, "tls", false, "Connect to the daemon over TLS")
+	clientFlags.StringVar(&opts.TLSCA, "tls-ca", "", "CA certificates used to verify the daemon (PEM)")
+	clientFlags.StringVar(&opts.TLSFingerprint, "tls-fingerprint", "", "Pin the daemon certificate by its SHA256 fingerprint")
+	clientFlags.BoolVar(&opts.TLSTOFU, "tls-tofu", false, "Trust the daemon certificate on first use (~/.fastsync/known_hosts)")
+	clientFlags.StringVar(&opts.TLSCert, "tls-cert", "", "Client certificate for mutual TLS (PEM)")
+	clientFlags.StringVar(&opts.TLSKey, "tls-key", "", "Client private key for mutual TLS (PEM)")
+
+	var hashAlgo string
+	clientFlags.StringVar(&hashAlgo, "hash-password", "", "Read a password from stdin and print its hash for the config file (scrypt, argon2id)")
+	clientFlags.Lookup("hash-password").NoOptDefVal = "scrypt"
 
 	clientFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [source] [target] [options]\n", os.Args[0])
@@ -69,7 +105,43 @@ func main() {
 		clientFlags.PrintDefaults()
 	}
 
-	clientFlags.Parse(os.Args[1:])
+	clientFlags.Parse(joinCompressArg(os.Args[1:]))
+
+	if hashAlgo != "" {
+		hashPassword(hashAlgo)
+		return
+	}
+
+	if opts.Compress != "" {
+		if _, _, err := protocol.ParseCompression(opts.Compress); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --compress: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	opts.SkipCompress = protocol.ParseExtensions(skipCompress)
+
+	if _, err := utils.ParseRateSchedule(opts.BwLimit); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --bwlimit: %v\n", err)
+		os.Exit(1)
+	}
+
+	if opts.Timeout < 0 || opts.ConTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --timeout or --contimeout, they must not be negative\n")
+		os.Exit(1)
+	}
+
+	switch opts.Reflink {
+	case client.ReflinkAuto, client.ReflinkAlways, client.ReflinkNever:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid --reflink %q, expected auto, always or never\n", opts.Reflink)
+		os.Exit(1)
+	}
+
+	if opts.ChunkSize, err = utils.ParseBytes(chunkSize); err != nil || opts.ChunkSize <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --chunk-size %q\n", chunkSize)
+		os.Exit(1)
+	}
 
 	args := clientFlags.Args()
 	if len(args) < 2 {
@@ -86,5 +158,63 @@ func main() {
 	logLevel := logger.LevelInfo
 	logger.SetGlobal(logger.New(os.Stdout, logLevel, ""))
 
-	client.Run(source, target, opts)
+	if err := client.Run(source, target, opts); err != nil {
+		logger.Error("Sync failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+// joinCompressArg attaches an algorithm following a bare -z or --compress
+// to the flag, so "-z zstd:3" works although the value is optional.
+// Without this, pflag would take "zstd:3" for the source path.
+func joinCompressArg(args []string) []string {
+	joined := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			joined = append(joined, args[i:]...)
+			break
+		}
+		if (arg == "-z" || arg == "--compress") && i+1 < len(args) {
+			if _, _, err := protocol.ParseCompression(args[i+1]); err == nil {
+				arg += "=" + args[i+1]
+				i++
+			}
+		}
+		joined = append(joined, arg)
+	}
+	return joined
+}
+
+// hashPassword prints a password hash to put into the instance config
+func hashPassword(algo string) {
+	var password []byte
+	var err error
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err = term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+	} else {
+		var line string
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err == io.EOF {
+			err = nil
+		}
+		password = []byte(strings.TrimRight(line, "\r\n"))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read password: %v\n", err)
+		os.Exit(1)
+	}
+	if len(password) == 0 {
+		fmt.Fprintln(os.Stderr, "Password must not be empty")
+		os.Exit(1)
+	}
+
+	hash, err := auth.HashPassword(string(password), algo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to hash password: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
 }
@@ -0,0 +1,282 @@
+// Package auth implements the challenge-response handshake used between
+// client and daemon. The password never crosses the wire and the daemon
+// doesn't need to store it.
+//
+// It works like SCRAM (RFC 5802): the salted password is derived from the
+// password with scrypt or argon2id, or is the plaintext password itself.
+//
+//	ClientKey = HMAC(SaltedPassword, "Client Key")
+//	StoredKey = SHA256(ClientKey)
+//	ServerKey = HMAC(SaltedPassword, "Server Key")
+//
+// The daemon keeps StoredKey and ServerKey and sends a random nonce. The
+// client proves it knows ClientKey with ClientKey XOR HMAC(StoredKey, msg),
+// where msg is the nonce and the instance name. The daemon recovers ClientKey
+// from it and checks its hash, then proves it knows ServerKey with
+// HMAC(ServerKey, msg). A leaked hash from the config therefore can't be used
+// to log in.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	NonceSize = 32
+	// KeyLen is the length of the salted password of new hashes
+	KeyLen = 32
+)
+
+// Limits on the KDF parameters the client runs for the daemon. They are far
+// above the defaults of HashPassword, but keep a malicious daemon from
+// exhausting the client's CPU or memory before it authenticated.
+const (
+	maxScryptMemory = 1 << 30 // 128 * N * r bytes
+	maxScryptLogN   = 20
+	maxScryptP      = 16
+	maxArgon2Memory = 1 << 20 // KiB
+	maxArgon2Time   = 16
+	maxArgon2P      = 64
+	maxKeyLen       = 1024
+)
+
+// Secret is the parsed form of an instance password from the config.
+// Setting is sent to clients so they can derive the same keys from the password.
+type Secret struct {
+	Setting   string // Hash setting without the keys, empty for plaintext
+	StoredKey []byte
+	ServerKey []byte
+}
+
+var b64 = base64.RawStdEncoding
+
+// ParseSecret parses a plaintext password or one of the supported hash formats:
+//
+//	$scrypt$ln=15,r=8,p=1$<salt>$<StoredKey>$<ServerKey>
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<StoredKey>$<ServerKey>
+func ParseSecret(s string) (*Secret, error) {
+	if !strings.HasPrefix(s, "$") {
+		salted := []byte(s)
+		return &Secret{StoredKey: storedKey(salted), ServerKey: serverKey(salted)}, nil
+	}
+	if strings.HasPrefix(s, "$2") {
+		return nil, fmt.Errorf("bcrypt hashes are not supported, create a scrypt or argon2id hash with --hash-password")
+	}
+
+	i := strings.LastIndex(s, "$")
+	j := strings.LastIndex(s[:max(i, 0)], "$")
+	if j < 0 {
+		return nil, fmt.Errorf("malformed password hash")
+	}
+	setting := s[:j+1]
+	if _, err := parseSetting(setting); err != nil {
+		return nil, err
+	}
+	stored, err1 := b64.DecodeString(s[j+1 : i])
+	server, err2 := b64.DecodeString(s[i+1:])
+	if err1 != nil || err2 != nil || len(stored) != sha256.Size || len(server) != sha256.Size {
+		return nil, fmt.Errorf("malformed keys in password hash")
+	}
+	return &Secret{Setting: setting, StoredKey: stored, ServerKey: server}, nil
+}
+
+// DeriveKey computes the salted password from the password and the setting
+// sent by the daemon. keyLen is the length of the salted password.
+// Settings with parameters beyond the client's limits are refused.
+func DeriveKey(password, setting string, keyLen int) ([]byte, error) {
+	if setting == "" {
+		return []byte(password), nil
+	}
+	if strings.HasPrefix(setting, "$2") {
+		return nil, fmt.Errorf("the daemon uses a bcrypt hash, which is not supported")
+	}
+	kdf, err := parseSetting(setting)
+	if err != nil {
+		return nil, err
+	}
+	if keyLen <= 0 || keyLen > maxKeyLen {
+		return nil, fmt.Errorf("invalid key length %d", keyLen)
+	}
+	kdf.keyLen = keyLen
+	return kdf.derive([]byte(password))
+}
+
+// NewNonce returns a random challenge
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+func clientKey(salted []byte) []byte {
+	return hmacSum(salted, []byte("Client Key"))
+}
+
+func storedKey(salted []byte) []byte {
+	h := sha256.Sum256(clientKey(salted))
+	return h[:]
+}
+
+func serverKey(salted []byte) []byte {
+	return hmacSum(salted, []byte("Server Key"))
+}
+
+// xor returns a XOR b, both of the same length
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// Proof is the client's answer to a challenge. The instance name is mixed in
+// so a proof can't be replayed against another instance sharing the password.
+func Proof(salted, nonce []byte, instance string) []byte {
+	ck := clientKey(salted)
+	h := sha256.Sum256(ck)
+	return xor(ck, hmacSum(h[:], nonce, []byte(instance)))
+}
+
+// Verify checks a client proof in constant time
+func Verify(secret *Secret, nonce []byte, instance string, proof []byte) bool {
+	if len(proof) != sha256.Size {
+		return false
+	}
+	ck := xor(proof, hmacSum(secret.StoredKey, nonce, []byte(instance)))
+	h := sha256.Sum256(ck)
+	return hmac.Equal(h[:], secret.StoredKey)
+}
+
+// ServerProof is the daemon's answer to a verified client, proving that it
+// knows the password too
+func ServerProof(secret *Secret, nonce []byte, instance string) []byte {
+	return hmacSum(secret.ServerKey, nonce, []byte(instance))
+}
+
+// VerifyServer checks the daemon's proof in constant time
+func VerifyServer(salted, nonce []byte, instance string, proof []byte) bool {
+	return hmac.Equal(hmacSum(serverKey(salted), nonce, []byte(instance)), proof)
+}
+
+// HashPassword creates a hash for the config file with default parameters.
+// algo is scrypt or argon2id.
+func HashPassword(password, algo string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	var setting string
+	switch algo {
+	case "scrypt":
+		setting = fmt.Sprintf("$scrypt$ln=15,r=8,p=1$%s$", b64.EncodeToString(salt))
+	case "argon2id":
+		setting = fmt.Sprintf("$argon2id$v=%d$m=65536,t=3,p=4$%s$", argon2.Version, b64.EncodeToString(salt))
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q, use scrypt or argon2id", algo)
+	}
+	salted, err := DeriveKey(password, setting, KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return setting + b64.EncodeToString(storedKey(salted)) + "$" + b64.EncodeToString(serverKey(salted)), nil
+}
+
+// kdf holds the parameters parsed from a scrypt or argon2id setting
+type kdf struct {
+	algo    string
+	salt    []byte
+	n, r, p int    // scrypt
+	m, t    uint32 // argon2id, p is shared
+	keyLen  int    // Length of the salted password
+}
+
+func (k *kdf) derive(password []byte) ([]byte, error) {
+	if k.algo == "scrypt" {
+		return scrypt.Key(password, k.salt, k.n, k.r, k.p, k.keyLen)
+	}
+	return argon2.IDKey(password, k.salt, k.t, k.m, uint8(k.p), uint32(k.keyLen)), nil
+}
+
+// parseSetting parses "$algo$[v=19$]params$salt$"
+func parseSetting(setting string) (*kdf, error) {
+	parts := strings.Split(setting, "$")
+	// Leading and trailing "$" produce empty parts
+	if len(parts) < 5 || parts[0] != "" || parts[len(parts)-1] != "" {
+		return nil, fmt.Errorf("malformed password hash")
+	}
+	parts = parts[1 : len(parts)-1]
+
+	k := &kdf{algo: parts[0]}
+	switch k.algo {
+	case "scrypt":
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("malformed scrypt hash")
+		}
+	case "argon2id":
+		if len(parts) != 4 || parts[1] != "v="+strconv.Itoa(argon2.Version) {
+			return nil, fmt.Errorf("malformed or unsupported argon2id hash")
+		}
+		parts = append(parts[:1], parts[2:]...)
+	default:
+		return nil, fmt.Errorf("unsupported password hash %q", k.algo)
+	}
+
+	params := map[string]int{}
+	for _, kv := range strings.Split(parts[1], ",") {
+		name, value, ok := strings.Cut(kv, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("malformed %s parameter %q", k.algo, kv)
+		}
+		params[name] = n
+	}
+	salt, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s salt", k.algo)
+	}
+	k.salt = salt
+
+	if k.algo == "scrypt" {
+		ln, r, p := params["ln"], params["r"], params["p"]
+		if ln == 0 || r == 0 || p == 0 {
+			return nil, fmt.Errorf("scrypt hash needs ln, r and p parameters")
+		}
+		if ln > maxScryptLogN || p > maxScryptP || r > (maxScryptMemory>>ln)/128 {
+			return nil, fmt.Errorf("scrypt parameters ln=%d,r=%d,p=%d exceed the limits (ln <= %d, p <= %d, 128*r*2^ln <= %d MiB)",
+				ln, r, p, maxScryptLogN, maxScryptP, maxScryptMemory>>20)
+		}
+		k.n, k.r, k.p = 1<<ln, r, p
+	} else {
+		m, t, p := params["m"], params["t"], params["p"]
+		if m == 0 || t == 0 || p == 0 {
+			return nil, fmt.Errorf("argon2id hash needs m, t and p parameters")
+		}
+		if m > maxArgon2Memory || t > maxArgon2Time || p > maxArgon2P {
+			return nil, fmt.Errorf("argon2id parameters m=%d,t=%d,p=%d exceed the limits (m <= %d, t <= %d, p <= %d)",
+				m, t, p, maxArgon2Memory, maxArgon2Time, maxArgon2P)
+		}
+		k.m, k.t, k.p = uint32(m), uint32(t), p
+	}
+	return k, nil
+}
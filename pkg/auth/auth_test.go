@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+// login derives the client's keys for secret and runs a challenge
+func login(t *testing.T, secret *Secret, password, instance string) (ok bool, serverOK bool) {
+	t.Helper()
+	salted, err := DeriveKey(password, secret.Setting, KeyLen)
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(secret, nonce, "default", Proof(salted, nonce, instance)) {
+		return false, false
+	}
+	return true, VerifyServer(salted, nonce, instance, ServerProof(secret, nonce, "default"))
+}
+
+func TestLogin(t *testing.T) {
+	plain, err := ParseSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]*Secret{"plaintext": plain}
+	for _, algo := range []string{"scrypt", "argon2id"} {
+		hash, err := HashPassword("secret", algo)
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if !strings.HasPrefix(hash, "$"+algo+"$") {
+			t.Fatalf("%s hash %q", algo, hash)
+		}
+		if secrets[algo], err = ParseSecret(hash); err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+	}
+
+	for name, secret := range secrets {
+		t.Run(name, func(t *testing.T) {
+			if ok, serverOK := login(t, secret, "secret", "default"); !ok || !serverOK {
+				t.Fatalf("login: %v, daemon proof: %v", ok, serverOK)
+			}
+			if ok, _ := login(t, secret, "wrong", "default"); ok {
+				t.Fatal("wrong password accepted")
+			}
+			// A proof is bound to the instance
+			if ok, _ := login(t, secret, "secret", "other"); ok {
+				t.Fatal("proof for another instance accepted")
+			}
+		})
+	}
+}
+
+func TestStoredKeyIsNoPassword(t *testing.T) {
+	hash, err := HashPassword("secret", "scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ParseSecret(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Someone who read the hash knows StoredKey and ServerKey
+	for _, key := range [][]byte{secret.StoredKey, secret.ServerKey} {
+		if Verify(secret, nonce, "default", Proof(key, nonce, "default")) {
+			t.Fatal("logged in with a key from the hash")
+		}
+	}
+	if Verify(secret, nonce, "default", ServerProof(secret, nonce, "default")) {
+		t.Fatal("daemon proof accepted as client proof")
+	}
+}
+
+func TestVerifyMalformedProof(t *testing.T) {
+	secret, _ := ParseSecret("secret")
+	nonce, _ := NewNonce()
+	for _, proof := range [][]byte{nil, make([]byte, 31), make([]byte, 33), make([]byte, 32)} {
+		if Verify(secret, nonce, "default", proof) {
+			t.Errorf("accepted proof of %d bytes", len(proof))
+		}
+	}
+}
+
+func TestParseSecretErrors(t *testing.T) {
+	hash, err := HashPassword("secret", "scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.LastIndex(hash, "$")
+	key := hash[i+1:]
+	setting := hash[:strings.LastIndex(hash[:i], "$")+1]
+
+	tests := []struct {
+		name, secret, want string
+	}{
+		{"bcrypt", "$2b$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234", "bcrypt"},
+		{"one key", setting + key, "malformed"},
+		{"no keys", setting, "malformed"},
+		{"only dollars", "$$", "malformed"},
+		{"unknown algorithm", "$md5$x=1$c2FsdA$" + key + "$" + key, "unsupported"},
+		{"short key", setting + key[:10] + "$" + key, "malformed keys"},
+		{"bad base64", setting + "!!!$" + key, "malformed keys"},
+		{"scrypt limits", "$scrypt$ln=30,r=8,p=1$c2FsdA$" + key + "$" + key, "limits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSecret(tt.secret)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSetting(t *testing.T) {
+	tests := []struct {
+		setting string
+		ok      bool
+	}{
+		{"$scrypt$ln=15,r=8,p=1$c2FsdA$", true},
+		{"$scrypt$ln=20,r=8,p=16$c2FsdA$", true}, // 1 GiB, the most allowed
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$", true},
+		{"$argon2id$v=19$m=1048576,t=16,p=64$c2FsdA$", true},
+
+		// Beyond the limits a malicious daemon could make the client run
+		{"$scrypt$ln=21,r=1,p=1$c2FsdA$", false},
+		{"$scrypt$ln=20,r=9,p=1$c2FsdA$", false},
+		{"$scrypt$ln=10,r=1048576,p=1$c2FsdA$", false},
+		{"$scrypt$ln=15,r=8,p=17$c2FsdA$", false},
+		{"$scrypt$ln=63,r=1,p=1$c2FsdA$", false},
+		{"$argon2id$v=19$m=1048577,t=3,p=4$c2FsdA$", false},
+		{"$argon2id$v=19$m=65536,t=17,p=4$c2FsdA$", false},
+		{"$argon2id$v=19$m=65536,t=3,p=65$c2FsdA$", false},
+
+		// Malformed
+		{"$scrypt$ln=15,r=8$c2FsdA$", false},
+		{"$scrypt$ln=15,r=8,p=0$c2FsdA$", false},
+		{"$scrypt$ln=15,r=-8,p=1$c2FsdA$", false},
+		{"$scrypt$ln=15,r=x,p=1$c2FsdA$", false},
+		{"$scrypt$ln15,r=8,p=1$c2FsdA$", false},
+		{"$scrypt$ln=15,r=8,p=1$!!$", false},
+		{"$scrypt$ln=15,r=8,p=1$c2FsdA", false},
+		{"scrypt$ln=15,r=8,p=1$c2FsdA$", false},
+		{"$scrypt$ln=15,r=8,p=1$extra$c2FsdA$", false},
+		{"$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$", false},
+		{"$argon2id$m=65536,t=3,p=4$c2FsdA$", false},
+		{"$argon2i$v=19$m=65536,t=3,p=4$c2FsdA$", false},
+		{"$2b$10$c2FsdA$", false},
+	}
+	for _, tt := range tests {
+		_, err := parseSetting(tt.setting)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSetting(%q): %v", tt.setting, err)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	const cheap = "$scrypt$ln=1,r=1,p=1$c2FsdA$"
+	k1, err := DeriveKey("secret", cheap, KeyLen)
+	if err != nil || len(k1) != KeyLen {
+		t.Fatalf("derived %d bytes, %v", len(k1), err)
+	}
+	k2, _ := DeriveKey("secret", cheap, KeyLen)
+	k3, _ := DeriveKey("secret", "$scrypt$ln=1,r=1,p=1$cGVwcGVy$", KeyLen)
+	if string(k1) != string(k2) || string(k1) == string(k3) {
+		t.Fatal("derived keys don't depend on password and salt only")
+	}
+
+	if k, err := DeriveKey("secret", "", KeyLen); err != nil || string(k) != "secret" {
+		t.Fatalf("plaintext derived %q, %v", k, err)
+	}
+	for _, keyLen := range []int{0, -1, maxKeyLen + 1} {
+		if _, err := DeriveKey("secret", cheap, keyLen); err == nil {
+			t.Errorf("key length %d accepted", keyLen)
+		}
+	}
+	if _, err := DeriveKey("secret", "$2b$10$c2FsdA$", KeyLen); err == nil || !strings.Contains(err.Error(), "bcrypt") {
+		t.Fatalf("bcrypt setting: %v", err)
+	}
+	if _, err := DeriveKey("secret", "$scrypt$ln=28,r=8,p=1$c2FsdA$", KeyLen); err == nil {
+		t.Fatal("scrypt setting beyond the limits accepted")
+	}
+}
+
+func TestHashPasswordUnknownAlgorithm(t *testing.T) {
+	if _, err := HashPassword("secret", "bcrypt"); err == nil {
+		t.Fatal("bcrypt hash created")
+	}
+}
@@ -0,0 +1,416 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// Files larger than the chunk size are split into ranges that are transferred
+// over several connections to the daemon at once. The receiver writes each
+// range at its offset into a temp file and only moves it into place after the
+// MD5 of the whole file matched the sender's.
+
+// chunked reports whether a is transferred in ranges over several connections
+func (o Options) chunked(a pkgSync.FileAction) bool {
+	return o.Parallel > 1 && o.ChunkSize > 0 && o.daemonHas(protocol.CapRanges) &&
+		!a.Info.IsDir && a.Info.Size > o.ChunkSize && !o.Inplace && !useDelta(a, o)
+}
+
+// errNoChunkConns means the pool has no connection, the daemon turned all
+// of them away. The file is transferred over the main connection instead.
+var errNoChunkConns = errors.New("no connection for chunks")
+
+// chunkPool holds the extra connections of chunked transfers. They are
+// opened on first use and shared by all files, at most opts.Parallel of them.
+// If the daemon turns one away, e.g. over its connection limit, the pool
+// makes do with those it has. If it has none, chunking is off for good.
+type chunkPool struct {
+	info     *RemoteInfo
+	isSender bool
+	opts     Options
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	idle []*protocol.Transport
+	n    int // Connections open or being opened
+	max  int // Connections the pool may open
+	// failed is why the pool couldn't open any connection, nil if it can
+	failed error
+}
+
+func newChunkPool(info *RemoteInfo, isSender bool, opts Options) *chunkPool {
+	// Every connection is a plain session, the ranges are the concurrency
+	opts.Streams = 1
+	p := &chunkPool{info: info, isSender: isSender, opts: opts, max: opts.Parallel}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// get returns an idle connection, opening a new one while below the limit
+func (p *chunkPool) get() (*protocol.Transport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(p.idle) == 0 && p.n >= p.max && p.failed == nil {
+			p.cond.Wait()
+		}
+		if p.failed != nil {
+			return nil, fmt.Errorf("%w: %v", errNoChunkConns, p.failed)
+		}
+		if len(p.idle) > 0 {
+			t := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			return t, nil
+		}
+		p.n++
+		p.mu.Unlock()
+
+		opts := p.opts
+		sess, err := connectAndAuth(p.info, p.isSender, &opts)
+		p.mu.Lock()
+		if err == nil {
+			return sess.t, nil
+		}
+		p.n--
+		p.cond.Signal()
+		if p.n == 0 {
+			logger.Warn("Transferring large files over the main connection: %v", err)
+			p.failed = err
+			p.cond.Broadcast()
+			return nil, fmt.Errorf("%w: %v", errNoChunkConns, err)
+		}
+		if p.max > p.n {
+			logger.Warn("Continuing with %d chunk connections: %v", p.n, err)
+			p.max = p.n
+		}
+	}
+}
+
+// available reports whether the pool can still transfer chunks
+func (p *chunkPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed == nil
+}
+
+// put returns a connection after use
+func (p *chunkPool) put(t *protocol.Transport) {
+	p.mu.Lock()
+	p.idle = append(p.idle, t)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// drop closes a connection that failed, its state is unknown
+func (p *chunkPool) drop(t *protocol.Transport) {
+	t.Close()
+	p.mu.Lock()
+	p.n--
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// close ends all connections, they must have been returned with put
+func (p *chunkPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.idle {
+		t.Send(protocol.MsgDone, nil)
+		t.Close()
+	}
+	p.idle = nil
+	p.n = 0
+}
+
+// run calls fn for each range of a file of size bytes, with up to
+// opts.Parallel ranges in flight. It returns the first error.
+func (p *chunkPool) run(size int64, fn func(t *protocol.Transport, offset, length int64) error) error {
+	type chunk struct{ offset, length int64 }
+	chunks := make(chan chunk)
+	stop := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	chunkSize := p.opts.ChunkSize
+	workers := int(min(int64(p.opts.Parallel), (size+chunkSize-1)/chunkSize))
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t, err := p.get()
+			if err != nil {
+				fail(err)
+				return
+			}
+			for c := range chunks {
+				if err := fn(t, c.offset, c.length); err != nil {
+					p.drop(t)
+					fail(err)
+					return
+				}
+			}
+			p.put(t)
+		}()
+	}
+
+feed:
+	for offset := int64(0); offset < size; offset += chunkSize {
+		select {
+		case chunks <- chunk{offset, min(chunkSize, size-offset)}:
+		case <-stop:
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	return firstErr
+}
+
+// roundTrip sends a request on a pool connection and reads the answer
+func (p *chunkPool) roundTrip(msgType protocol.MessageType, payload []byte) (protocol.MessageType, []byte, error) {
+	t, err := p.get()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = t.Send(msgType, payload); err != nil {
+		p.drop(t)
+		return 0, nil, err
+	}
+	mt, data, err := t.ReadData()
+	if err != nil {
+		p.drop(t)
+		return 0, nil, err
+	}
+	p.put(t)
+	return mt, data, nil
+}
+
+// pushChunked pushes the file at srcPath in ranges and has the daemon move
+// it into place once its hash matches
+func pushChunked(pool *chunkPool, srcPath string, a pkgSync.FileAction, bar *progressbar.ProgressBar) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Hash while the ranges are sent
+	type hashResult struct {
+		hash string
+		err  error
+	}
+	hashed := make(chan hashResult, 1)
+	go func() {
+		hash, err := pkgSync.CalculateHash(srcPath)
+		hashed <- hashResult{hash, err}
+	}()
+
+	err = pool.run(info.Size(), func(t *protocol.Transport, offset, length int64) error {
+		return pushRange(t, f, a.Path, offset, length, bar)
+	})
+	local := <-hashed
+	if err != nil {
+		return err
+	}
+	if local.err != nil {
+		return local.err
+	}
+
+	commit, _ := json.Marshal(protocol.RangeCommit{
+		Path:    a.Path,
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode()),
+		ModTime: info.ModTime().Unix(),
+		Hash:    local.hash,
+	})
+	mt, data, err := pool.roundTrip(protocol.MsgRangeCommit, commit)
+	if err != nil {
+		return err
+	}
+	return rangeReply(mt, data)
+}
+
+// pushRange sends the range offset+length of f and waits for the daemon to
+// acknowledge it
+func pushRange(t *protocol.Transport, f *os.File, relPath string, offset, length int64, bar *progressbar.ProgressBar) error {
+	if err := t.SendJSON(protocol.MsgRangeStart, protocol.RangeMsg{Path: relPath, Offset: offset, Length: length}); err != nil {
+		return err
+	}
+	t.BeginFile(relPath)
+	buf := make([]byte, 32*1024)
+	r := io.NewSectionReader(f, offset, length)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := t.Send(protocol.MsgData, buf[:n]); err != nil {
+				return err
+			}
+			bar.Add(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if err := t.Send(protocol.MsgEndFile, nil); err != nil {
+		return err
+	}
+	mt, data, err := t.ReadData()
+	if err != nil {
+		return err
+	}
+	return rangeReply(mt, data)
+}
+
+// rangeReply checks the daemon's answer to a range or commit
+func rangeReply(mt protocol.MessageType, data []byte) error {
+	switch mt {
+	case protocol.MsgRangeDone:
+		return nil
+	case protocol.MsgError:
+		return fmt.Errorf("remote error: %w", protocol.DecodeError(data))
+	default:
+		return fmt.Errorf("unexpected message type %v", mt)
+	}
+}
+
+// pullChunked pulls a file in ranges into a temp file next to tgtPath and
+// moves it into place once its hash matches the daemon's. The hash is
+// requested over t, which must be idle, so all pool connections carry ranges.
+func pullChunked(t *protocol.Transport, pool *chunkPool, a pkgSync.FileAction, tgtPath string, modTime int64, bar *progressbar.ProgressBar) error {
+	os.MkdirAll(filepath.Dir(tgtPath), 0755)
+	tmpPath := utils.TempPath(tgtPath)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// The daemon hashes its copy while the ranges arrive
+	type hashResult struct {
+		info protocol.FileHash
+		err  error
+	}
+	hashed := make(chan hashResult, 1)
+	go func() {
+		var r hashResult
+		r.err = t.Send(protocol.MsgHashReq, []byte(a.Path))
+		if r.err == nil {
+			var mt protocol.MessageType
+			var data []byte
+			if mt, data, r.err = t.ReadData(); r.err == nil {
+				r.err = hashReply(mt, data, &r.info)
+			}
+		}
+		hashed <- r
+	}()
+
+	err = pool.run(a.Info.Size, func(t *protocol.Transport, offset, length int64) error {
+		return pullRange(t, tmpPath, a.Path, offset, length, bar)
+	})
+	remote := <-hashed
+	if err == nil {
+		err = remote.err
+	}
+	if err == nil && remote.info.Size != a.Info.Size {
+		err = fmt.Errorf("file changed on the daemon during the transfer")
+	}
+	if err == nil {
+		var hash string
+		hash, err = pkgSync.CalculateHash(tmpPath)
+		if err == nil && hash != remote.info.Hash {
+			err = pkgSync.ErrHashMismatch
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	return utils.CommitFile(f, tgtPath, a.Info.Mode, modTime)
+}
+
+// hashReply decodes the daemon's answer to a hash request
+func hashReply(mt protocol.MessageType, data []byte, info *protocol.FileHash) error {
+	switch mt {
+	case protocol.MsgHashInfo:
+		return json.Unmarshal(data, info)
+	case protocol.MsgError:
+		return fmt.Errorf("remote error: %w", protocol.DecodeError(data))
+	default:
+		return fmt.Errorf("unexpected message type %v", mt)
+	}
+}
+
+// pullRange requests the range offset+length of relPath and writes it into
+// the file at tmpPath. Each range writes through its own file handle, so
+// the kernel can splice the data from the connection.
+func pullRange(t *protocol.Transport, tmpPath, relPath string, offset, length int64, bar *progressbar.ProgressBar) error {
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := t.SendJSON(protocol.MsgRangeReq, protocol.RangeMsg{Path: relPath, Offset: offset, Length: length}); err != nil {
+		return err
+	}
+	pos, end := offset, offset+length
+	for {
+		mt, size, err := t.ReadHeader()
+		if err != nil {
+			return err
+		}
+		switch mt {
+		case protocol.MsgData:
+			if pos+int64(size) > end {
+				return fmt.Errorf("data exceeds range %d+%d", offset, length)
+			}
+			n, err := io.CopyN(f, t.GetConn(), int64(size))
+			pos += n
+			bar.Add64(n)
+			if err != nil {
+				return err
+			}
+		case protocol.MsgEndFile:
+			if pos != end {
+				return fmt.Errorf("file changed on the daemon during the transfer")
+			}
+			return f.Close()
+		case protocol.MsgError:
+			data := make([]byte, size)
+			if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+				return err
+			}
+			return fmt.Errorf("remote error: %w", protocol.DecodeError(data))
+		default:
+			return fmt.Errorf("unexpected message type %v", mt)
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package client
 
 import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
+	"github.com/taurusxin/fastsync/pkg/auth"
 	"github.com/taurusxin/fastsync/pkg/logger"
 
 	"github.com/taurusxin/fastsync/pkg/protocol"
@@ -33,13 +41,66 @@ func newProgressBar(max int64, description string) *progressbar.ProgressBar {
 	)
 }
 
+// Reflink modes of local copies
+const (
+	ReflinkAuto   = "auto"   // Share data blocks if the filesystem supports it, copy otherwise
+	ReflinkAlways = "always" // Fail if the blocks can't be shared
+	ReflinkNever  = "never"  // Always copy the data
+)
+
 type Options struct {
-	Delete    bool
-	Overwrite bool
-	Checksum  bool
-	Compress  bool
-	Archive   bool
-	Verbose   bool
+	Delete       bool
+	Overwrite    bool
+	Checksum     bool
+	Compress     string   // Compression as "algo[:level]", empty for none
+	SkipCompress []string // Extensions whose data isn't compressed, in addition to protocol.DefaultSkipCompress
+	Archive      bool     // Accepted for compatibility, times and permissions are always preserved
+	Verbose      bool
+	SizeOnly     bool
+	IgnoreTimes  bool
+	ModifyWindow int64
+	Delta        bool
+	Inplace      bool
+	JSONFileList bool   // Receive the file list as JSON, for debugging
+	Streams      int    // Files transferred concurrently over a multiplexed connection
+	Workers      int    // Files copied concurrently in a local sync
+	Reflink      string // ReflinkAuto, ReflinkAlways or ReflinkNever for local copies
+	Parallel     int    // Connections a large file is transferred over in chunks
+	ChunkSize    int64  // Files larger than this are transferred in chunks of this size
+	BwLimit      string // Bandwidth limit of the daemon connections, see utils.ParseRateSchedule
+	Timeout      int    // Seconds without data from the daemon before giving up, 0 for no limit
+	ConTimeout   int    // Seconds to connect and authenticate, 0 for the system default
+
+	TLS            bool
+	TLSCA          string
+	TLSFingerprint string
+	TLSTOFU        bool
+	TLSCert        string
+	TLSKey         string
+
+	// caps are the capabilities negotiated with the daemon
+	caps []string
+	// limiter enforces BwLimit across all connections
+	limiter *utils.RateLimiter
+	// failed collects the files that failed, shared by all copies of the options
+	failed *failures
+}
+
+// daemonHas reports whether the daemon supports capability c
+func (o Options) daemonHas(c string) bool {
+	return protocol.HasCapability(o.caps, c)
+}
+
+// compareOptions returns the subset of options used by pkgSync.Compare
+func (o Options) compareOptions() pkgSync.Options {
+	return pkgSync.Options{
+		Delete:       o.Delete,
+		Overwrite:    o.Overwrite,
+		Checksum:     o.Checksum,
+		SizeOnly:     o.SizeOnly,
+		IgnoreTimes:  o.IgnoreTimes,
+		ModifyWindow: o.ModifyWindow,
+	}
 }
 
 type RemoteInfo struct {
@@ -85,7 +146,9 @@ func parseRemote(s string) *RemoteInfo {
 	return info
 }
 
-func Run(source, target string, opts Options) {
+// Run syncs source to target. It returns an error if the sync was aborted
+// or any file failed, after logging a summary of the failed files.
+func Run(source, target string, opts Options) error {
 	srcRemote := parseRemote(source)
 	tgtRemote := parseRemote(target)
 
@@ -94,54 +157,50 @@ func Run(source, target string, opts Options) {
 		os.Exit(1)
 	}
 
+	var err error
+	if opts.limiter, err = utils.NewRateLimiter(opts.BwLimit); err != nil {
+		logger.Error("Invalid bandwidth limit: %v", err)
+		os.Exit(1)
+	}
+
+	opts.failed = &failures{}
 	start := time.Now()
 
 	if srcRemote == nil && tgtRemote == nil {
-		syncLocalLocal(source, target, opts)
+		err = syncLocalLocal(source, target, opts)
 	} else if srcRemote != nil {
-		syncRemoteLocal(srcRemote, target, opts)
+		err = syncRemoteLocal(srcRemote, target, opts)
 	} else {
-		syncLocalRemote(source, tgtRemote, opts)
+		err = syncLocalRemote(source, tgtRemote, opts)
 	}
 
+	opts.failed.report()
+	if err == nil {
+		err = opts.failed.err()
+	}
+	if err != nil {
+		return err
+	}
 	logger.Info("Sync completed in %.2fs", time.Since(start).Seconds())
+	return nil
 }
 
-func syncLocalLocal(source, target string, opts Options) {
+func syncLocalLocal(source, target string, opts Options) error {
 	logger.Info("Syncing Local %s -> Local %s", source, target)
 
-	// Scan Source
-	srcFiles, err := pkgSync.Scan(source, nil, opts.Checksum)
-	if err != nil {
-		logger.Error("Failed to scan source: %v", err)
-		return
-	}
+	// Scan source and target while comparing
+	srcFiles := pkgSync.Walk(source, nil, opts.Checksum)
+	tgtFiles := targetFileList(target, nil, opts.Checksum)
 
-	// Scan Target
-	tgtFiles, err := pkgSync.Scan(target, nil, opts.Checksum)
+	copies, deletes, err := splitActions(pkgSync.Compare(srcFiles, tgtFiles, opts.compareOptions()))
 	if err != nil {
-		// If target doesn't exist, it's empty
-		if !os.IsNotExist(err) {
-			logger.Warn("Failed to scan target (assuming empty): %v", err)
-		}
-		tgtFiles = []protocol.FileInfo{}
+		return fmt.Errorf("failed to scan: %w", err)
 	}
 
-	actions := pkgSync.Compare(srcFiles, tgtFiles, pkgSync.Options{
-		Delete:    opts.Delete,
-		Overwrite: opts.Overwrite,
-		Checksum:  opts.Checksum,
-	})
-
-	logger.Info("Found %d actions", len(actions))
+	logger.Info("Found %d actions", len(copies)+len(deletes))
 
 	// Calculate total size for summary
-	var totalSize int64
-	for _, a := range actions {
-		if a.Type == pkgSync.ActionCopy {
-			totalSize += a.Info.Size
-		}
-	}
+	totalSize := actionsSize(copies)
 
 	// Check if source is a file
 	srcInfo, _ := os.Stat(source)
@@ -149,7 +208,23 @@ func syncLocalLocal(source, target string, opts Options) {
 
 	startTime := time.Now()
 
-	for _, a := range actions {
+	// Directories are created first, so the files in them can be copied in any order
+	var files []pkgSync.FileAction
+	for _, a := range copies {
+		if !a.Info.IsDir {
+			files = append(files, a)
+			continue
+		}
+		logger.Info("Creating directory %s", a.Path)
+		tgtPath, _ := utils.SecureJoin(target, a.Path)
+		if err := os.MkdirAll(tgtPath, 0755); err != nil {
+			logger.Error("Error creating directory %s: %v", a.Path, err)
+			opts.failed.add(a.Path, err)
+		}
+	}
+
+	prog := newProgress(opts.Workers > 1, totalSize, "Copying")
+	forEachAction(opts.Workers, files, func(a pkgSync.FileAction) {
 		var srcPath string
 		var err error
 		if isSourceFile {
@@ -158,48 +233,56 @@ func syncLocalLocal(source, target string, opts Options) {
 			srcPath, err = utils.SecureJoin(source, a.Path)
 			if err != nil {
 				logger.Error("Error processing %s: %v", a.Path, err)
-				continue
+				opts.failed.add(a.Path, err)
+				return
 			}
 		}
 		tgtPath, _ := utils.SecureJoin(target, a.Path)
 
-		switch a.Type {
-		case pkgSync.ActionCopy:
-			if a.Info.IsDir {
-				logger.Info("Creating directory %s", a.Path)
-				if err := os.MkdirAll(tgtPath, 0755); err != nil {
-					logger.Error("Error creating directory %s: %v", a.Path, err)
-				}
-				continue
-			}
-			if opts.Verbose {
-				logger.Info("Copying %s", a.Path)
-			}
-			bar := newProgressBar(
-				a.Info.Size,
-				fmt.Sprintf("Copying %s", a.Path),
-			)
-			if err := copyFile(srcPath, tgtPath, a.Info.Mode, bar); err != nil {
-				logger.Error("Error copying %s: %v", a.Path, err)
-				continue
-			}
-			bar.Finish()
-			if opts.Archive {
-				if a.Info.ModTime > 0 {
-					os.Chtimes(tgtPath, time.Unix(a.Info.ModTime, 0), time.Unix(a.Info.ModTime, 0))
-				}
-				// Mode is already set by copyFile but maybe strict chmod is needed?
-				os.Chmod(tgtPath, os.FileMode(a.Info.Mode))
-			}
-		case pkgSync.ActionDelete:
-			if opts.Verbose {
-				logger.Info("Deleting %s", a.Path)
-			}
-			if err := os.RemoveAll(tgtPath); err != nil {
-				logger.Error("Error deleting %s: %v", a.Path, err)
-			}
+		if opts.Verbose {
+			logger.Info("Copying %s", a.Path)
+		}
+		bar := prog.file(a.Info.Size, fmt.Sprintf("Copying %s", a.Path))
+		// The quick check of the next run needs the source's time
+		modTime := a.Info.ModTime
+		if useDelta(a, opts) {
+			err = deltaCopyFile(srcPath, tgtPath, a.Info.Mode, modTime, bar)
+		} else {
+			err = copyFile(srcPath, tgtPath, a.Info.Mode, modTime, opts.Inplace, opts.Reflink, bar)
+		}
+		prog.done(bar)
+		if err != nil {
+			logger.Error("Error copying %s: %v", a.Path, err)
+			opts.failed.add(a.Path, err)
+		}
+	})
+	prog.finish()
+
+	// Files are deleted concurrently. Directories go last, deepest first,
+	// once the files in them are gone.
+	var fileDeletes, dirDeletes []pkgSync.FileAction
+	for _, a := range deletes {
+		if a.Info.IsDir {
+			dirDeletes = append(dirDeletes, a)
+		} else {
+			fileDeletes = append(fileDeletes, a)
+		}
+	}
+	remove := func(a pkgSync.FileAction) {
+		if opts.Verbose {
+			logger.Info("Deleting %s", a.Path)
+		}
+		tgtPath, _ := utils.SecureJoin(target, a.Path)
+		os.Remove(utils.PartialPath(tgtPath))
+		if err := os.RemoveAll(tgtPath); err != nil {
+			logger.Error("Error deleting %s: %v", a.Path, err)
+			opts.failed.add(a.Path, err)
 		}
 	}
+	forEachAction(opts.Workers, fileDeletes, remove)
+	for _, a := range dirDeletes {
+		remove(a)
+	}
 
 	elapsed := time.Since(startTime)
 	var avgSpeed float64
@@ -207,9 +290,32 @@ func syncLocalLocal(source, target string, opts Options) {
 		avgSpeed = float64(totalSize) / elapsed.Seconds()
 	}
 	logger.Info("Total size: %s, Time elapsed: %.2fs, Average speed: %s/s", utils.FormatBytes(totalSize), elapsed.Seconds(), utils.FormatBytes(int64(avgSpeed)))
+	return nil
+}
+
+// forEachAction calls fn for every action on up to n goroutines and waits for them
+func forEachAction(n int, actions []pkgSync.FileAction, fn func(a pkgSync.FileAction)) {
+	ch := make(chan pkgSync.FileAction)
+	var wg sync.WaitGroup
+	for range max(1, min(n, len(actions))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range ch {
+				fn(a)
+			}
+		}()
+	}
+	for _, a := range actions {
+		ch <- a
+	}
+	close(ch)
+	wg.Wait()
 }
 
-func copyFile(src, dst string, mode uint32, bar *progressbar.ProgressBar) error {
+// copyFile copies src to a temp file next to dst and renames it into place,
+// or writes dst directly when inplace is set. See copyData for reflink.
+func copyFile(src, dst string, mode uint32, modTime int64, inplace bool, reflink string, bar *progressbar.ProgressBar) error {
 	s, err := os.Open(src)
 	if err != nil {
 		return err
@@ -217,209 +323,330 @@ func copyFile(src, dst string, mode uint32, bar *progressbar.ProgressBar) error
 	defer s.Close()
 
 	os.MkdirAll(filepath.Dir(dst), 0755)
-	d, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
+	tmpPath := utils.TempPath(dst)
+	if inplace {
+		tmpPath = dst
+	}
+	d, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
 	if err != nil {
 		return err
 	}
-	defer d.Close()
 
+	if err = copyData(d, s, reflink, bar); err != nil {
+		d.Close()
+		if !inplace {
+			os.Remove(tmpPath)
+		}
+		return err
+	}
+	return utils.CommitFile(d, dst, mode, modTime)
+}
+
+// copyChunk is how much copyData copies in the kernel before it updates the progress bar
+const copyChunk = 8 * 1024 * 1024
+
+// copyData copies the content of s to the empty file d. With reflink "auto"
+// or "always" d shares the blocks of s if the filesystem supports it, where
+// "always" fails otherwise. Else the data is copied inside the kernel where
+// possible, and read through user space as the last resort.
+func copyData(d, s *os.File, reflink string, bar *progressbar.ProgressBar) error {
+	add := func(n int64) {
+		if bar != nil {
+			bar.Add64(n)
+		}
+	}
+
+	if reflink == ReflinkAuto || reflink == ReflinkAlways {
+		err := utils.Reflink(d, s)
+		if err == nil {
+			info, err := s.Stat()
+			if err == nil {
+				add(info.Size())
+			}
+			return err
+		}
+		if reflink == ReflinkAlways {
+			return fmt.Errorf("reflink failed: %w", err)
+		}
+	}
+
+	for {
+		n, err := utils.CopyFileRange(d, s, copyChunk)
+		add(n)
+		if errors.Is(err, errors.ErrUnsupported) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+
+	// Continue where the kernel copy stopped
 	var writer io.Writer = d
 	if bar != nil {
 		writer = io.MultiWriter(d, bar)
 	}
-
-	_, err = io.Copy(writer, s)
+	_, err := io.Copy(writer, s)
 	return err
 }
 
-func connectAndAuth(info *RemoteInfo, isSender bool, opts Options) (*protocol.Transport, string, error) {
+// connectAndAuth connects to the daemon and authenticates. Features the daemon
+// doesn't support are switched off in opts.
+func connectAndAuth(info *RemoteInfo, isSender bool, opts *Options) (*session, error) {
 	addr := net.JoinHostPort(info.Host, strconv.Itoa(info.Port))
-	conn, err := net.Dial("tcp", addr)
+	conTimeout := time.Duration(opts.ConTimeout) * time.Second
+	dialer := net.Dialer{Timeout: conTimeout}
+	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	if conTimeout > 0 {
+		// Covers the TLS handshake and authentication too
+		conn.SetDeadline(time.Now().Add(conTimeout))
+	}
+	if opts.useTLS() {
+		tlsCfg, err := clientTLSConfig(info, *opts)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
 	}
 	t := protocol.NewTransport(conn)
 
 	// Auth
 	req := protocol.AuthRequest{
-		Instance: info.Instance,
-		Password: info.Password,
-		IsSender: isSender,
-		Compress: opts.Compress,
+		Version:      protocol.ProtocolVersion,
+		Capabilities: opts.capabilities(),
+		Instance:     info.Instance,
+		IsSender:     isSender,
+		Compression:  opts.Compress,
+		SkipCompress: opts.SkipCompress,
+		IdleTimeout:  opts.Timeout,
 	}
 	if err := t.SendJSON(protocol.MsgAuthReq, req); err != nil {
 		t.Close()
-		return nil, "", err
+		return nil, err
 	}
 
-	var resp protocol.AuthResponse
-	if _, err := t.ReadJSON(&resp); err != nil {
+	resp, err := readAuthResponse(t, info)
+	if err != nil {
 		t.Close()
-		return nil, "", err
+		return nil, err
 	}
 	if !resp.Success {
 		t.Close()
-		return nil, "", fmt.Errorf("auth failed: %s", resp.Message)
+		return nil, fmt.Errorf("auth failed: %s", resp.Message)
+	}
+	if _, err := protocol.NegotiateVersion(resp.Version); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("incompatible daemon: %w", err)
+	}
+	opts.downgrade(resp)
+	conn.SetDeadline(time.Time{})
+	t.SetIdleTimeout(time.Duration(opts.Timeout) * time.Second)
+	t.LimitRate(opts.limiter)
+
+	sess := &session{t: t, exclude: resp.Exclude}
+	if opts.Compress != "" {
+		// Applied to the session transports below
+		algo, level, _ := protocol.ParseCompression(opts.Compress)
+		sess.mc = &protocol.MessageCompression{
+			Algo:  algo,
+			Level: level,
+			Skip:  append(slices.Clone(opts.SkipCompress), resp.SkipCompress...),
+		}
+	}
+
+	if opts.daemonHas(protocol.CapHeartbeat) {
+		t.StartHeartbeat(time.Duration(resp.IdleTimeout) * time.Second)
+	}
+
+	if opts.daemonHas(protocol.CapMux) {
+		sess.mux = protocol.NewMux(t, true)
+		sess.t = protocol.NewTransport(sess.mux.Control())
+	}
+	if err := sess.enableMessageCompression(sess.t); err != nil {
+		sess.close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// readAuthResponse reads the daemon's answer to the auth request.
+// If the instance has a password, the daemon challenges us first. With a
+// password given, a daemon that doesn't prove it knows it is rejected.
+func readAuthResponse(t *protocol.Transport, info *RemoteInfo) (*protocol.AuthResponse, error) {
+	mt, data, err := t.ReadData()
+	if err != nil {
+		return nil, err
 	}
 
-	if opts.Compress {
-		if err := t.EnableCompression(); err != nil {
-			t.Close()
-			return nil, "", err
+	if mt == protocol.MsgAuthChallenge {
+		var ch protocol.AuthChallenge
+		if err := json.Unmarshal(data, &ch); err != nil {
+			return nil, err
 		}
+		salted, err := auth.DeriveKey(info.Password, ch.Setting, ch.KeyLen)
+		if err != nil {
+			return nil, err
+		}
+		proof := protocol.AuthProof{Proof: auth.Proof(salted, ch.Nonce, info.Instance)}
+		if err := t.SendJSON(protocol.MsgAuthProof, proof); err != nil {
+			return nil, err
+		}
+		if mt, data, err = t.ReadData(); err != nil {
+			return nil, err
+		}
+		if mt == protocol.MsgAuthResp {
+			resp, err := decodeAuthResponse(data)
+			// The daemon proves it knows the password as well
+			if err == nil && resp.Success && !auth.VerifyServer(salted, ch.Nonce, info.Instance, resp.ServerProof) {
+				err = fmt.Errorf("the daemon failed to prove that it knows the password")
+			}
+			return resp, err
+		}
+	}
+
+	if mt != protocol.MsgAuthResp {
+		return nil, fmt.Errorf("unexpected message type: %v", mt)
+	}
+	resp, err := decodeAuthResponse(data)
+	// Without a challenge anyone could pose as the daemon
+	if err == nil && resp.Success && info.Password != "" {
+		err = fmt.Errorf("the daemon accepted the login without checking the password")
+	}
+	return resp, err
+}
+
+func decodeAuthResponse(data []byte) (*protocol.AuthResponse, error) {
+	var resp protocol.AuthResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
 	}
+	return &resp, nil
+}
+
+// capabilities returns the capabilities announced to the daemon
+func (o Options) capabilities() []string {
+	caps := protocol.Capabilities()
+	if o.JSONFileList {
+		caps = slices.DeleteFunc(caps, func(c string) bool { return c == protocol.CapFileListBinary })
+	}
+	if o.Streams <= 1 {
+		caps = slices.DeleteFunc(caps, func(c string) bool { return c == protocol.CapMux })
+	}
+	return caps
+}
 
-	return t, resp.Exclude, nil
+// downgrade turns off the requested features the daemon's answer lacks
+func (o *Options) downgrade(resp *protocol.AuthResponse) {
+	caps := resp.Capabilities
+	if o.Compress != "" {
+		algo, _, _ := protocol.ParseCompression(o.Compress)
+		used := resp.Compression
+		if !protocol.HasCapability(caps, protocol.CapCompressMsgs) {
+			used = ""
+		}
+		switch used {
+		case "":
+			logger.Warn("Daemon does not support compression, transferring uncompressed")
+		case algo:
+			used = o.Compress // Keep the level
+		default:
+			logger.Warn("Daemon does not support %s compression, using %s", algo, used)
+		}
+		o.Compress = used
+	}
+	if o.Checksum && !protocol.HasCapability(caps, protocol.CapHashMD5) {
+		logger.Warn("Daemon does not support checksums, comparing size and time instead")
+		o.Checksum = false
+	}
+	if o.Delta && !protocol.HasCapability(caps, protocol.CapDelta) {
+		logger.Warn("Daemon does not support delta transfer, sending whole files")
+		o.Delta = false
+	}
+	if o.Parallel > 1 && !protocol.HasCapability(caps, protocol.CapRanges) {
+		logger.Warn("Daemon does not support chunked transfers, using a single connection per file")
+		o.Parallel = 1
+	}
+	o.caps = caps
 }
 
-func syncRemoteLocal(srcInfo *RemoteInfo, target string, opts Options) {
+func syncRemoteLocal(srcInfo *RemoteInfo, target string, opts Options) error {
 	logger.Info("Syncing Remote %s -> Local %s", srcInfo.Host, target)
 
 	// 1. Connect Main
-	t, remoteExcludes, err := connectAndAuth(srcInfo, false, opts) // Client is Receiver (Sender=false)
+	sess, err := connectAndAuth(srcInfo, false, &opts) // Client is Receiver (Sender=false)
 	if err != nil {
-		logger.Error("Connection failed: %v", err)
-		return
+		return fmt.Errorf("connection failed: %w", err)
 	}
-	defer t.Close() // Main connection
+	defer sess.close() // Main connection
+	t := sess.t
 
 	// 2. Request File List
 	req := protocol.FileListRequest{
 		Checksum: opts.Checksum,
 	}
 	if err = t.SendJSON(protocol.MsgFileList, req); err != nil {
-		logger.Error("Failed to request file list: %v", err)
-		return
-	}
-
-	var srcFiles []protocol.FileInfo
-	if _, err = t.ReadJSON(&srcFiles); err != nil {
-		logger.Error("Failed to read file list: %v", err)
-		return
+		return fmt.Errorf("failed to request file list: %w", err)
 	}
 
-	// 3. Scan Local Target
+	// 3. Scan Local Target and compare while the file list arrives
 	excludes := []string{}
-	if remoteExcludes != "" {
-		excludes = strings.Split(remoteExcludes, ",")
-	}
-	tgtFiles, scanErr := pkgSync.Scan(target, excludes, opts.Checksum)
-	if scanErr != nil {
-		tgtFiles = []protocol.FileInfo{}
+	if sess.exclude != "" {
+		excludes = strings.Split(sess.exclude, ",")
 	}
+	srcFiles := remoteFileList(t, opts)
+	tgtFiles := targetFileList(target, excludes, opts.Checksum)
 
 	// 4. Compare
-	actions := pkgSync.Compare(srcFiles, tgtFiles, pkgSync.Options{
-		Delete:    opts.Delete,
-		Overwrite: opts.Overwrite,
-		Checksum:  opts.Checksum,
-	})
-	logger.Info("Found %d actions", len(actions))
+	copies, deletes, err := splitActions(pkgSync.Compare(srcFiles, tgtFiles, opts.compareOptions()))
+	if err != nil {
+		return fmt.Errorf("failed to compare file lists: %w", err)
+	}
+	logger.Info("Found %d actions", len(copies)+len(deletes))
 
 	// Calculate total size for summary
-	var totalSize int64
-	for _, a := range actions {
-		if a.Type == pkgSync.ActionCopy {
-			totalSize += a.Info.Size
-		}
-	}
+	totalSize := actionsSize(copies)
 
 	startTime := time.Now()
 
-	// 5. Execute
-	for _, a := range actions {
-		tgtPath, _ := utils.SecureJoin(target, a.Path)
-
-		switch a.Type {
-		case pkgSync.ActionDelete:
-			if opts.Verbose {
-				logger.Info("Deleting %s", a.Path)
-			}
-			if err = os.Remove(tgtPath); err != nil {
-				logger.Error("Error deleting %s: %v", a.Path, err)
-			}
-
-		case pkgSync.ActionCopy:
-			if opts.Verbose {
-				logger.Info("Pulling %s", a.Path)
-			}
-
-			// Request File
-			if err = t.Send(protocol.MsgFileReq, []byte(a.Path)); err != nil {
-				logger.Error("Error requesting file %s: %v", a.Path, err)
-				continue
-			}
-
-			// Receive Start
-			var startMsg protocol.StartFileMsg
-			var mt protocol.MessageType
-			mt, err = t.ReadJSON(&startMsg)
-			if err != nil {
-				logger.Error("Error reading start msg for %s: %v", a.Path, err)
-				continue
-			}
-			if mt == protocol.MsgError {
-				logger.Error("Remote error for %s", a.Path)
-				continue
-			}
-
-			// Ensure dir exists
-			os.MkdirAll(filepath.Dir(tgtPath), 0755)
-
-			if os.FileMode(startMsg.Mode).IsDir() {
-				os.MkdirAll(tgtPath, 0755)
-				// Read EndFile
-				mt, _, err = t.ReadHeader()
-				if err != nil {
-					logger.Error("Error reading end file for dir %s: %v", a.Path, err)
-					continue
-				}
-				if mt != protocol.MsgEndFile {
-					logger.Error("Expected EndFile for dir %s", a.Path)
-				}
-				continue
-			}
-
-			f, err := os.OpenFile(tgtPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(startMsg.Mode))
-			if err != nil {
-				logger.Error("Error opening file %s: %v", tgtPath, err)
-				continue
-			}
-
-			bar := newProgressBar(
-				startMsg.Size,
-				fmt.Sprintf("Pulling %s", a.Path),
-			)
-
-			// Read Data
-			var data []byte
-			for {
-				mt, data, err = t.ReadData()
-				if err != nil {
-					f.Close()
-					logger.Error("Error reading data for %s: %v", a.Path, err)
-					break
-				}
-				if mt == protocol.MsgEndFile {
-					break
-				}
-				if mt == protocol.MsgData {
-					n, _ := f.Write(data)
-					bar.Add(n)
-				}
-			}
-			bar.Finish()
-			f.Close()
+	// 5. Pull, with a worker per stream
+	streams, err := sess.transferStreams(opts.Streams)
+	if err != nil {
+		return fmt.Errorf("failed to open streams: %w", err)
+	}
+	pool := newChunkPool(srcInfo, false, opts)
+	err = transferVerified(copies, opts.failed, func(copies []pkgSync.FileAction, retry *retryList) error {
+		prog := newProgress(len(streams) > 1, actionsSize(copies), "Pulling")
+		defer prog.finish()
+		return runWorkers(streams, copies, func(st *protocol.Transport, actions <-chan pkgSync.FileAction, stop <-chan struct{}) error {
+			return pullFiles(st, actions, stop, target, opts, prog, pool, retry)
+		})
+	})
+	pool.close()
+	sess.closeStreams(streams, err != nil)
+	if err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
 
-			// Restore attributes if Archive mode is enabled
-			if opts.Archive {
-				if startMsg.ModTime > 0 {
-					os.Chtimes(tgtPath, time.Unix(startMsg.ModTime, 0), time.Unix(startMsg.ModTime, 0))
-				}
-				if startMsg.Mode > 0 {
-					os.Chmod(tgtPath, os.FileMode(startMsg.Mode))
-				}
-			}
+	for _, a := range deletes {
+		if opts.Verbose {
+			logger.Info("Deleting %s", a.Path)
+		}
+		tgtPath, _ := utils.SecureJoin(target, a.Path)
+		if err = utils.RemovePath(tgtPath); err != nil {
+			logger.Error("Error deleting %s: %v", a.Path, err)
+			opts.failed.add(a.Path, err)
 		}
 	}
 
@@ -431,54 +658,65 @@ func syncRemoteLocal(srcInfo *RemoteInfo, target string, opts Options) {
 		avgSpeed = float64(totalSize) / elapsed.Seconds()
 	}
 	logger.Info("Total size: %s, Time elapsed: %.2fs, Average speed: %s/s", utils.FormatBytes(totalSize), elapsed.Seconds(), utils.FormatBytes(int64(avgSpeed)))
+	return nil
+}
+
+// splitActions collects the copies and the deletes of actions. Deletes are
+// reversed, so the contents of a directory are deleted before the directory.
+func splitActions(actions pkgSync.ActionIter) (copies, deletes []pkgSync.FileAction, err error) {
+	for a, err := range actions {
+		if err != nil {
+			return nil, nil, err
+		}
+		if a.Type == pkgSync.ActionDelete {
+			deletes = append(deletes, a)
+		} else {
+			copies = append(copies, a)
+		}
+	}
+	slices.Reverse(deletes)
+	return copies, deletes, nil
+}
+
+// actionsSize returns the bytes to transfer for actions
+func actionsSize(actions []pkgSync.FileAction) int64 {
+	var size int64
+	for _, a := range actions {
+		size += a.Info.Size
+	}
+	return size
 }
 
-func syncLocalRemote(source string, tgtInfo *RemoteInfo, opts Options) {
+func syncLocalRemote(source string, tgtInfo *RemoteInfo, opts Options) error {
 	logger.Info("Syncing Local %s -> Remote %s", source, tgtInfo.Host)
 
-	t, remoteExcludes, err := connectAndAuth(tgtInfo, true, opts) // Client is Sender
+	sess, err := connectAndAuth(tgtInfo, true, &opts) // Client is Sender
 	if err != nil {
-		logger.Error("Connection failed: %v", err)
-		return
+		return fmt.Errorf("connection failed: %w", err)
 	}
-	defer t.Close()
+	defer sess.close()
+	t := sess.t
 
 	// Request Remote File List
 	if err = t.Send(protocol.MsgFileList, nil); err != nil {
-		logger.Error("Failed to request file list: %v", err)
-		return
-	}
-	var tgtFiles []protocol.FileInfo
-	if _, err = t.ReadJSON(&tgtFiles); err != nil {
-		logger.Error("Failed to read file list: %v", err)
-		return
+		return fmt.Errorf("failed to request file list: %w", err)
 	}
-
-	// Scan Local
+	// Scan Local and compare while the file list arrives
 	excludes := []string{}
-	if remoteExcludes != "" {
-		excludes = strings.Split(remoteExcludes, ",")
-	}
-	srcFiles, scanErr := pkgSync.Scan(source, excludes, opts.Checksum)
-	if scanErr != nil {
-		logger.Error("Failed to scan local: %v", scanErr)
-		return
+	if sess.exclude != "" {
+		excludes = strings.Split(sess.exclude, ",")
 	}
+	srcFiles := pkgSync.Walk(source, excludes, opts.Checksum)
+	tgtFiles := remoteFileList(t, opts)
 
-	actions := pkgSync.Compare(srcFiles, tgtFiles, pkgSync.Options{
-		Delete:    opts.Delete,
-		Overwrite: opts.Overwrite,
-		Checksum:  opts.Checksum,
-	})
-	logger.Info("Found %d actions", len(actions))
+	copies, deletes, err := splitActions(pkgSync.Compare(srcFiles, tgtFiles, opts.compareOptions()))
+	if err != nil {
+		return fmt.Errorf("failed to compare file lists: %w", err)
+	}
+	logger.Info("Found %d actions", len(copies)+len(deletes))
 
 	// Calculate total size for summary
-	var totalSize int64
-	for _, a := range actions {
-		if a.Type == pkgSync.ActionCopy {
-			totalSize += a.Info.Size
-		}
-	}
+	totalSize := actionsSize(copies)
 
 	startTime := time.Now()
 
@@ -486,7 +724,71 @@ func syncLocalRemote(source string, tgtInfo *RemoteInfo, opts Options) {
 	srcInfo, _ := os.Stat(source)
 	isSourceFile := srcInfo != nil && !srcInfo.IsDir()
 
-	for _, a := range actions {
+	streams, err := sess.transferStreams(opts.Streams)
+	if err != nil {
+		return fmt.Errorf("failed to open streams: %w", err)
+	}
+	pool := newChunkPool(tgtInfo, true, opts)
+	err = transferVerified(copies, opts.failed, func(copies []pkgSync.FileAction, retry *retryList) error {
+		prog := newProgress(len(streams) > 1, actionsSize(copies), "Pushing")
+		defer prog.finish()
+		return runWorkers(streams, copies, func(st *protocol.Transport, actions <-chan pkgSync.FileAction, stop <-chan struct{}) error {
+			return pushFiles(st, actions, stop, source, isSourceFile, opts, prog, pool, retry)
+		})
+	})
+	pool.close()
+	sess.closeStreams(streams, err != nil)
+	if err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
+
+	// The daemon answers each delete with CapResults
+	acks := newPendingAcks(t, protocol.CapResults, opts, nil)
+	for _, a := range deletes {
+		if opts.Verbose {
+			logger.Info("Remote Deleting %s", a.Path)
+		}
+		if err = t.Send(protocol.MsgDeleteFile, []byte(a.Path)); err == nil {
+			err = acks.add(a)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", a.Path, err)
+		}
+	}
+	if err = acks.drain(); err != nil {
+		return fmt.Errorf("failed to read delete results: %w", err)
+	}
+
+	t.Send(protocol.MsgDone, nil)
+
+	elapsed := time.Since(startTime)
+	var avgSpeed float64
+	if totalSize > 0 && elapsed.Seconds() > 0 {
+		avgSpeed = float64(totalSize) / elapsed.Seconds()
+	}
+	logger.Info("Total size: %s, Time elapsed: %.2fs, Average speed: %s/s", utils.FormatBytes(totalSize), elapsed.Seconds(), utils.FormatBytes(int64(avgSpeed)))
+	return nil
+}
+
+// pushFiles pushes the files of the copy actions received on actions over t,
+// large files in chunks over the connections of pool. Files the daemon
+// received corrupted are added to retry.
+// It returns an error if the connection failed.
+func pushFiles(t *protocol.Transport, actions <-chan pkgSync.FileAction, stop <-chan struct{}, source string, isSourceFile bool, opts Options, prog *progress, pool *chunkPool, retry *retryList) error {
+	buf := make([]byte, 32*1024)
+	acks := newPendingAcks(t, protocol.CapVerify, opts, retry)
+	for {
+		var a pkgSync.FileAction
+		var ok bool
+		select {
+		case a, ok = <-actions:
+			if !ok {
+				return acks.drain()
+			}
+		case <-stop:
+			return acks.drain()
+		}
+
 		var srcPath string
 		var err error
 		if isSourceFile {
@@ -495,77 +797,151 @@ func syncLocalRemote(source string, tgtInfo *RemoteInfo, opts Options) {
 			srcPath, err = utils.SecureJoin(source, a.Path)
 			if err != nil {
 				logger.Error("Error secure join %s: %v", a.Path, err)
+				opts.failed.add(a.Path, err)
 				continue
 			}
 		}
 
-		switch a.Type {
-		case pkgSync.ActionDelete:
-			if opts.Verbose {
-				logger.Info("Remote Deleting %s", a.Path)
-			}
-			t.Send(protocol.MsgDeleteFile, []byte(a.Path))
+		if opts.Verbose {
+			logger.Info("Pushing %s", a.Path)
+		}
 
-		case pkgSync.ActionCopy:
-			if opts.Verbose {
-				logger.Info("Pushing %s", a.Path)
+		if a.Info.IsDir {
+			err = t.SendJSON(protocol.MsgStartFile, protocol.StartFileMsg{
+				Path: a.Path,
+				Size: 0,
+				Mode: uint32(a.Info.Mode),
+			})
+			if err == nil {
+				err = t.Send(protocol.MsgEndFile, nil)
 			}
-
-			if a.Info.IsDir {
-				t.SendJSON(protocol.MsgStartFile, protocol.StartFileMsg{
-					Path: a.Path,
-					Size: 0,
-					Mode: uint32(a.Info.Mode),
-				})
-				t.Send(protocol.MsgEndFile, nil)
-				continue
+			if err != nil {
+				logger.Error("Error pushing directory %s: %v", a.Path, err)
+				return err
+			}
+			if err := acks.add(a); err != nil {
+				return err
 			}
+			continue
+		}
 
-			f, openErr := os.Open(srcPath)
-			if openErr != nil {
-				logger.Error("Error opening %s: %v", srcPath, openErr)
+		if opts.chunked(a) && pool.available() {
+			bar := prog.file(a.Info.Size, fmt.Sprintf("Pushing %s", a.Path))
+			err = pushChunked(pool, srcPath, a, bar)
+			prog.done(bar)
+			// Without chunk connections the file is pushed like any other
+			if !errors.Is(err, errNoChunkConns) {
+				if err != nil {
+					logger.Error("Error pushing %s in chunks: %v", a.Path, err)
+					if errors.Is(err, pkgSync.ErrHashMismatch) {
+						retry.add(a)
+					} else {
+						opts.failed.add(a.Path, err)
+					}
+				}
 				continue
 			}
+		}
 
-			info, _ := f.Stat()
+		f, openErr := os.Open(srcPath)
+		if openErr != nil {
+			logger.Error("Error opening %s: %v", srcPath, openErr)
+			opts.failed.add(a.Path, openErr)
+			continue
+		}
 
-			// Send Start
-			t.SendJSON(protocol.MsgStartFile, protocol.StartFileMsg{
-				Path:    a.Path,
-				Size:    info.Size(),
-				Mode:    uint32(info.Mode()),
-				ModTime: info.ModTime().Unix(),
-			})
+		info, _ := f.Stat()
+		start := protocol.StartFileMsg{
+			Path:    a.Path,
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode()),
+			ModTime: info.ModTime().Unix(),
+		}
 
-			bar := newProgressBar(
-				info.Size(),
-				fmt.Sprintf("Pushing %s", a.Path),
-			)
-
-			// Send Data
-			buf := make([]byte, 32*1024)
-			for {
-				n, readErr := f.Read(buf)
-				if n > 0 {
-					t.Send(protocol.MsgData, buf[:n])
-					bar.Add(n)
-				}
-				if readErr != nil {
-					break
-				}
+		bar := prog.file(info.Size(), fmt.Sprintf("Pushing %s", a.Path))
+
+		if useDelta(a, opts) {
+			// The daemon's signature is the next answer
+			err = acks.drain()
+			if err == nil {
+				err = pushDelta(t, f, start, opts.daemonHas(protocol.CapVerify), bar)
 			}
-			bar.Finish()
-			t.Send(protocol.MsgEndFile, nil)
+			prog.done(bar)
 			f.Close()
+			if err == nil {
+				err = acks.add(a)
+			}
+			if err != nil {
+				logger.Error("Error pushing delta for %s: %v", a.Path, err)
+				return err
+			}
+			continue
+		}
+
+		start.Inplace = opts.Inplace
+		if info.Size() >= resumeMinSize && !opts.Inplace && opts.daemonHas(protocol.CapResume) {
+			// Continue an interrupted push if the daemon kept a matching partial file
+			err = acks.drain()
+			if err == nil {
+				start.Offset, err = remotePartialOffset(t, a.Path, f)
+			}
+			if err != nil {
+				logger.Error("Error querying partial file for %s: %v", a.Path, err)
+				f.Close()
+				return err
+			}
+			bar.Add64(start.Offset)
+		}
+
+		err = pushData(t, f, start, opts.daemonHas(protocol.CapVerify), buf, bar)
+		prog.done(bar)
+		f.Close()
+		if err == nil {
+			err = acks.add(a)
+		}
+		if err != nil {
+			logger.Error("Error pushing %s: %v", a.Path, err)
+			return err
+		}
+	}
+}
+
+// pushData sends StartFile, the data of f from start.Offset on and EndFile.
+// With verify EndFile carries the hash of the whole file as it was read.
+func pushData(t *protocol.Transport, f *os.File, start protocol.StartFileMsg, verify bool, buf []byte, bar *progressbar.ProgressBar) error {
+	h := md5.New()
+	if verify && start.Offset > 0 {
+		// The resumed prefix counts too
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, start.Offset)); err != nil {
+			return err
 		}
 	}
 
-	t.Send(protocol.MsgDone, nil)
+	if err := t.SendJSON(protocol.MsgStartFile, start); err != nil {
+		return err
+	}
+	t.BeginFile(start.Path)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if err := t.Send(protocol.MsgData, buf[:n]); err != nil {
+				return err
+			}
+			bar.Add(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// The receiver can't tell a short file, so the transfer ends
+			return readErr
+		}
+	}
 
-	elapsed := time.Since(startTime)
-	var avgSpeed float64
-	if totalSize > 0 && elapsed.Seconds() > 0 {
-		avgSpeed = float64(totalSize) / elapsed.Seconds()
+	var hash []byte
+	if verify {
+		hash = []byte(hex.EncodeToString(h.Sum(nil)))
 	}
-	logger.Info("Total size: %s, Time elapsed: %.2fs, Average speed: %s/s", utils.FormatBytes(totalSize), elapsed.Seconds(), utils.FormatBytes(int64(avgSpeed)))
+	return t.Send(protocol.MsgEndFile, hash)
 }
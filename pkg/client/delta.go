@@ -0,0 +1,177 @@
+package client
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// useDelta reports whether an action should be transferred as a delta.
+// New files have no basis on the receiver, so they are always sent whole.
+// In place updates would overwrite the basis while it's read, so they are sent whole too.
+func useDelta(a pkgSync.FileAction, opts Options) bool {
+	return opts.Delta && !opts.Inplace && a.Reason != "new" && !a.Info.IsDir
+}
+
+// localSignature computes the signature of the file at path.
+// A missing or unreadable file yields an empty signature.
+func localSignature(path string) (*pkgSync.Signature, *os.File) {
+	empty := &pkgSync.Signature{BlockSize: pkgSync.BlockSizeFor(0)}
+	f, err := os.Open(path)
+	if err != nil {
+		return empty, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return empty, nil
+	}
+	sig, err := pkgSync.ComputeSignature(f, pkgSync.BlockSizeFor(info.Size()))
+	if err != nil {
+		f.Close()
+		return empty, nil
+	}
+	return sig, f
+}
+
+// pushDelta sends the file as a delta against the daemon's copy.
+// StartFile has to be answered with the remote signature first.
+// With verify EndFile carries the hash of the whole file.
+func pushDelta(t *protocol.Transport, f *os.File, start protocol.StartFileMsg, verify bool, bar *progressbar.ProgressBar) error {
+	start.Delta = true
+	if err := t.SendJSON(protocol.MsgStartFile, start); err != nil {
+		return err
+	}
+
+	mt, data, err := t.ReadData()
+	if err != nil {
+		return err
+	}
+	if mt != protocol.MsgSignature {
+		return fmt.Errorf("expected signature, got message type %v", mt)
+	}
+	var sig pkgSync.Signature
+	if err := sig.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	h := md5.New()
+	err = pkgSync.ComputeDelta(io.TeeReader(f, io.MultiWriter(bar, h)), &sig, func(op pkgSync.DeltaOp) error {
+		data, _ := op.MarshalBinary()
+		return t.Send(protocol.MsgDelta, data)
+	})
+	if err != nil {
+		return err
+	}
+	var hash []byte
+	if verify {
+		hash = []byte(hex.EncodeToString(h.Sum(nil)))
+	}
+	return t.Send(protocol.MsgEndFile, hash)
+}
+
+// sendDeltaReq asks the daemon for a file as a delta against sig
+func sendDeltaReq(t *protocol.Transport, path string, sig *pkgSync.Signature) error {
+	data, err := sig.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return t.Send(protocol.MsgDeltaReq, protocol.EncodeDeltaReq(path, data))
+}
+
+// receiveDelta rebuilds a pulled file from MsgDelta messages into a temp file,
+// then renames it over tgtPath once it matches the hash in EndFile. basis is
+// nil when there is no local copy. fileErr means the file couldn't be stored,
+// err that the connection failed.
+func receiveDelta(t *protocol.Transport, tgtPath string, mode uint32, modTime int64, basis *os.File, sig *pkgSync.Signature, bar *progressbar.ProgressBar) (fileErr, err error) {
+	tmpPath := utils.TempPath(tgtPath)
+	f, fileErr := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if fileErr != nil {
+		return fileErr, t.DiscardFile()
+	}
+
+	var basisReader io.ReaderAt
+	if basis != nil {
+		basisReader = basis
+	}
+	applier := pkgSync.NewDeltaApplier(basisReader, sig, f)
+	var hash string
+	for {
+		mt, data, err := t.ReadData()
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return nil, err
+		}
+		if mt == protocol.MsgEndFile {
+			hash = string(data)
+			break
+		}
+		if mt != protocol.MsgDelta {
+			f.Close()
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("unexpected message type %v", mt)
+		}
+		if fileErr != nil {
+			continue
+		}
+		var op pkgSync.DeltaOp
+		if fileErr = op.UnmarshalBinary(data); fileErr == nil {
+			var n int64
+			n, fileErr = applier.Apply(op)
+			bar.Add64(n)
+		}
+	}
+	if fileErr == nil {
+		fileErr = pkgSync.VerifyHash(tmpPath, hash)
+	}
+	if fileErr != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fileErr, nil
+	}
+	return utils.CommitFile(f, tgtPath, mode, modTime), nil
+}
+
+// deltaCopyFile is the local equivalent of a delta transfer.
+// The new file is assembled from matching blocks of the existing target
+// and literal data from the source.
+func deltaCopyFile(src, dst string, mode uint32, modTime int64, bar *progressbar.ProgressBar) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	sig, basis := localSignature(dst)
+	var basisReader io.ReaderAt
+	if basis != nil {
+		defer basis.Close()
+		basisReader = basis
+	}
+
+	tmpPath := utils.TempPath(dst)
+	d, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+
+	applier := pkgSync.NewDeltaApplier(basisReader, sig, d)
+	err = pkgSync.ComputeDelta(io.TeeReader(s, bar), sig, func(op pkgSync.DeltaOp) error {
+		_, err := applier.Apply(op)
+		return err
+	})
+	if err != nil {
+		d.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	return utils.CommitFile(d, dst, mode, modTime)
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/taurusxin/fastsync/pkg/logger"
+)
+
+// maxListedFailures is how many failed files the summary lists by name
+const maxListedFailures = 50
+
+// failure is a file that couldn't be transferred or deleted
+type failure struct {
+	path string
+	err  error
+}
+
+// failures collects the files that failed during a sync, so they can be
+// summarized at the end and make the sync fail
+type failures struct {
+	mu   sync.Mutex
+	list []failure
+}
+
+func (f *failures) add(path string, err error) {
+	f.mu.Lock()
+	f.list = append(f.list, failure{path, err})
+	f.mu.Unlock()
+}
+
+// report logs the failed files, if any
+func (f *failures) report() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.list) == 0 {
+		return
+	}
+	slices.SortStableFunc(f.list, func(a, b failure) int { return strings.Compare(a.path, b.path) })
+	logger.Error("%d files failed:", len(f.list))
+	for _, fl := range f.list[:min(len(f.list), maxListedFailures)] {
+		logger.Error("  %s: %v", fl.path, fl.err)
+	}
+	if n := len(f.list) - maxListedFailures; n > 0 {
+		logger.Error("  ... and %d more", n)
+	}
+}
+
+// err returns an error if any file failed
+func (f *failures) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.list) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d files failed", len(f.list))
+}
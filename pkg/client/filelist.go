@@ -0,0 +1,64 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+)
+
+// remoteFileList yields the file list sent by the daemon as it arrives.
+// Daemons without CapFileList send the whole list in a single message.
+func remoteFileList(t *protocol.Transport, opts Options) pkgSync.FileIter {
+	batched := opts.daemonHas(protocol.CapFileList)
+	binary := batched && opts.daemonHas(protocol.CapFileListBinary)
+	return func(yield func(protocol.FileInfo, error) bool) {
+		for {
+			msgType, data, err := t.ReadData()
+			if err != nil {
+				yield(protocol.FileInfo{}, err)
+				return
+			}
+			switch msgType {
+			case protocol.MsgFileList:
+			case protocol.MsgFileListEnd:
+				return
+			case protocol.MsgError:
+				yield(protocol.FileInfo{}, fmt.Errorf("remote error: %w", protocol.DecodeError(data)))
+				return
+			default:
+				yield(protocol.FileInfo{}, fmt.Errorf("unexpected message type: %v", msgType))
+				return
+			}
+
+			var batch []protocol.FileInfo
+			if binary {
+				batch, err = protocol.DecodeFileList(data)
+			} else {
+				err = json.Unmarshal(data, &batch)
+			}
+			if err != nil {
+				yield(protocol.FileInfo{}, err)
+				return
+			}
+			for _, fi := range batch {
+				if !yield(fi, nil) {
+					return
+				}
+			}
+			if !batched {
+				return
+			}
+		}
+	}
+}
+
+// targetFileList walks the local target, a missing target is empty
+func targetFileList(root string, excludes []string, calcHash bool) pkgSync.FileIter {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return pkgSync.FileList(nil)
+	}
+	return pkgSync.Walk(root, excludes, calcHash)
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// pipelineDepth is how many file requests a pull keeps in flight.
+// The daemon answers requests in order, so responses are matched by position.
+const pipelineDepth = 64
+
+// pullRequest is an action whose file request has already been sent
+type pullRequest struct {
+	action  pkgSync.FileAction
+	tgtPath string
+	// Basis and signature of a delta request
+	sig   *pkgSync.Signature
+	basis *os.File
+	// err is set if the request could not be sent, no response will follow
+	err error
+	// resume is closed once a chunked file is pulled. No requests are sent
+	// until then, their responses would stall behind the chunks.
+	resume chan struct{}
+}
+
+func (r *pullRequest) close() {
+	if r.basis != nil {
+		r.basis.Close()
+		r.basis = nil
+	}
+}
+
+// send requests the file as a resume, a delta or a whole file
+func (r *pullRequest) send(t *protocol.Transport, opts Options) error {
+	a := r.action
+	if partial := localPartial(r.tgtPath, a.Path); partial != nil && !opts.Inplace && opts.daemonHas(protocol.CapResume) {
+		return t.SendJSON(protocol.MsgResumeReq, partial)
+	}
+	if useDelta(a, opts) {
+		r.sig, r.basis = localSignature(r.tgtPath)
+		return sendDeltaReq(t, a.Path, r.sig)
+	}
+	return t.Send(protocol.MsgFileReq, []byte(a.Path))
+}
+
+// sendRequests sends the file requests for actions ahead of their responses
+// and queues them in order. Chunked files are queued without a request, they
+// are pulled over the chunk connections. It stops after a failed send or when
+// stop is closed, and closes queue when it returns.
+func sendRequests(t *protocol.Transport, actions <-chan pkgSync.FileAction, target string, opts Options, queue chan<- *pullRequest, stop <-chan struct{}) {
+	defer close(queue)
+	for {
+		var a pkgSync.FileAction
+		var ok bool
+		select {
+		case a, ok = <-actions:
+			if !ok {
+				return
+			}
+		case <-stop:
+			return
+		}
+
+		req := &pullRequest{action: a}
+		req.tgtPath, _ = utils.SecureJoin(target, a.Path)
+		if opts.chunked(a) {
+			req.resume = make(chan struct{})
+		} else if req.err = req.send(t, opts); req.err != nil {
+			req.close()
+		}
+
+		select {
+		case queue <- req:
+		case <-stop:
+			req.close()
+			return
+		}
+		if req.err != nil {
+			return
+		}
+		if req.resume != nil {
+			select {
+			case <-req.resume:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// pullFiles pulls the files of the copy actions received on actions over t,
+// large files in chunks over the connections of pool. Requests are sent ahead
+// in the background while the responses are read. Files that arrived
+// corrupted are added to retry.
+// It returns an error if the connection failed. When stop is closed it returns
+// with requests outstanding, the transfer failed and its streams are reset.
+func pullFiles(t *protocol.Transport, actions <-chan pkgSync.FileAction, stop <-chan struct{}, target string, opts Options, prog *progress, pool *chunkPool, retry *retryList) error {
+	queue := make(chan *pullRequest, pipelineDepth)
+	done := make(chan struct{})
+	go sendRequests(t, actions, target, opts, queue, done)
+	defer func() {
+		close(done)
+		// Release what was queued but never handled
+		go func() {
+			for req := range queue {
+				req.close()
+			}
+		}()
+	}()
+
+	for {
+		var req *pullRequest
+		select {
+		case req = <-queue:
+		case <-stop:
+			return nil
+		}
+		if req == nil {
+			return nil
+		}
+		a, tgtPath := req.action, req.tgtPath
+
+		if opts.Verbose {
+			logger.Info("Pulling %s", a.Path)
+		}
+
+		if req.err != nil {
+			logger.Error("Error requesting file %s: %v", a.Path, req.err)
+			opts.failed.add(a.Path, req.err)
+			continue
+		}
+
+		if req.resume != nil {
+			var err error
+			if pool.available() {
+				bar := prog.file(a.Info.Size, fmt.Sprintf("Pulling %s", a.Path))
+				err = pullChunked(t, pool, a, tgtPath, a.Info.ModTime, bar)
+				prog.done(bar)
+			} else {
+				err = errNoChunkConns
+			}
+			if errors.Is(err, errNoChunkConns) {
+				// Request it over this connection like any other file, no
+				// other request is sent before resume is closed
+				err = req.send(t, opts)
+				close(req.resume)
+				if err != nil {
+					req.close()
+					logger.Error("Error requesting file %s: %v", a.Path, err)
+					return err
+				}
+			} else {
+				close(req.resume)
+				if err != nil {
+					logger.Error("Error pulling %s in chunks: %v", a.Path, err)
+					if errors.Is(err, pkgSync.ErrHashMismatch) {
+						retry.add(a)
+					} else {
+						opts.failed.add(a.Path, err)
+					}
+				}
+				continue
+			}
+		}
+
+		// Receive Start
+		var startMsg protocol.StartFileMsg
+		mt, data, err := t.ReadData()
+		if err == nil && mt == protocol.MsgStartFile {
+			err = json.Unmarshal(data, &startMsg)
+		}
+		if err != nil || mt != protocol.MsgStartFile || !startMsg.Delta {
+			req.close()
+		}
+		if err != nil {
+			logger.Error("Error reading start msg for %s: %v", a.Path, err)
+			opts.failed.add(a.Path, err)
+			continue
+		}
+		if mt == protocol.MsgError {
+			remoteErr := protocol.DecodeError(data)
+			logger.Error("Remote error for %s: %s (%s)", a.Path, remoteErr.Message, remoteErr.Code)
+			opts.failed.add(a.Path, fmt.Errorf("remote error: %w", remoteErr))
+			continue
+		}
+		if mt != protocol.MsgStartFile {
+			return fmt.Errorf("unexpected message type %v", mt)
+		}
+
+		// Ensure dir exists
+		os.MkdirAll(filepath.Dir(tgtPath), 0755)
+
+		if os.FileMode(startMsg.Mode).IsDir() {
+			err = os.MkdirAll(tgtPath, 0755)
+			if err != nil {
+				logger.Error("Error creating directory %s: %v", a.Path, err)
+				opts.failed.add(a.Path, err)
+			}
+			if discardErr := t.DiscardFile(); discardErr != nil {
+				logger.Error("Error reading end file for dir %s: %v", a.Path, discardErr)
+				return discardErr
+			}
+			if err := sendAck(t, opts, a.Path, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The quick check of the next run needs the source's time
+		modTime := startMsg.ModTime
+
+		var fileErr error
+		if startMsg.Delta {
+			bar := prog.file(startMsg.Size, fmt.Sprintf("Pulling %s", a.Path))
+			fileErr, err = receiveDelta(t, tgtPath, startMsg.Mode, modTime, req.basis, req.sig, bar)
+			req.close()
+			prog.done(bar)
+			if err != nil {
+				logger.Error("Error receiving delta for %s: %v", a.Path, err)
+				return err
+			}
+		} else {
+			fileErr, err = receiveFile(t, a, tgtPath, startMsg, modTime, opts.Inplace, prog)
+			if err != nil {
+				logger.Error("Error reading data for %s: %v", a.Path, err)
+				return err
+			}
+		}
+		if fileErr != nil {
+			logger.Error("Error receiving %s: %v", a.Path, fileErr)
+			if errors.Is(fileErr, pkgSync.ErrHashMismatch) {
+				retry.add(a)
+			} else {
+				opts.failed.add(a.Path, fileErr)
+			}
+		}
+		if err := sendAck(t, opts, a.Path, fileErr); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveFile writes the data of a pulled file to its partial file and moves
+// it into place once it matches the hash in EndFile. fileErr means the file
+// couldn't be stored, err that the connection failed.
+func receiveFile(t *protocol.Transport, a pkgSync.FileAction, tgtPath string, startMsg protocol.StartFileMsg, modTime int64, inplace bool, prog *progress) (fileErr, err error) {
+	var f *os.File
+	if inplace {
+		f, err = os.OpenFile(tgtPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(startMsg.Mode))
+	} else {
+		// Write to the partial file, so an interrupted pull can be resumed
+		f, err = utils.OpenPartial(utils.PartialPath(tgtPath), startMsg.Offset)
+	}
+	if err != nil {
+		return err, t.DiscardFile()
+	}
+
+	bar := prog.file(startMsg.Size, fmt.Sprintf("Pulling %s", a.Path))
+	bar.Add64(startMsg.Offset)
+
+	// Copying from the connection into the file lets the kernel splice
+	// the data of an uncompressed TCP connection
+	hash, fileErr, err := t.ReceiveData(f, func(n int64) { bar.Add64(n) })
+	prog.done(bar)
+	if err != nil {
+		// The partial file is kept, the next run resumes from it
+		f.Close()
+		return nil, err
+	}
+	if fileErr == nil {
+		fileErr = pkgSync.VerifyHash(f.Name(), string(hash))
+	}
+	if fileErr != nil {
+		f.Close()
+		if !inplace {
+			// Its content can't be trusted to resume from
+			os.Remove(f.Name())
+		}
+		return fileErr, nil
+	}
+	return utils.CommitFile(f, tgtPath, startMsg.Mode, modTime), nil
+}
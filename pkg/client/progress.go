@@ -0,0 +1,41 @@
+package client
+
+import (
+	"github.com/schollz/progressbar/v3"
+)
+
+// progress hands out a progress bar per file. When files are transferred
+// concurrently, their bars would overwrite each other, so all of them
+// report to one bar for the whole transfer instead.
+type progress struct {
+	total *progressbar.ProgressBar
+}
+
+func newProgress(concurrent bool, totalSize int64, description string) *progress {
+	if !concurrent {
+		return &progress{}
+	}
+	return &progress{total: newProgressBar(totalSize, description)}
+}
+
+// file returns the bar to report the transfer of one file to
+func (p *progress) file(size int64, description string) *progressbar.ProgressBar {
+	if p.total != nil {
+		return p.total
+	}
+	return newProgressBar(size, description)
+}
+
+// done finishes a bar returned by file
+func (p *progress) done(bar *progressbar.ProgressBar) {
+	if bar != p.total {
+		bar.Finish()
+	}
+}
+
+// finish finishes the bar of the whole transfer
+func (p *progress) finish() {
+	if p.total != nil {
+		p.total.Finish()
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// resumeMinSize is the smallest file for which a push asks the daemon about
+// a partial copy first. Smaller files are cheaper to resend than the round trip.
+const resumeMinSize = 1024 * 1024
+
+// localPartial describes what is left of an interrupted pull of tgtPath,
+// or returns nil if there is nothing to resume. A stale partial file is removed.
+func localPartial(tgtPath, relPath string) *protocol.PartialInfo {
+	partPath := utils.PartialPath(tgtPath)
+	info, err := os.Stat(partPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	if utils.StalePartial(info) {
+		os.Remove(partPath)
+		return nil
+	}
+	hash, err := pkgSync.CalculateHash(partPath)
+	if err != nil {
+		return nil
+	}
+	return &protocol.PartialInfo{Path: relPath, Offset: info.Size(), Hash: hash}
+}
+
+// remotePartialOffset asks the daemon for its partial copy of relPath and
+// returns the offset to continue from. The daemon's prefix is only trusted
+// if it hashes the same as ours, in which case f is left positioned there.
+func remotePartialOffset(t *protocol.Transport, relPath string, f *os.File) (int64, error) {
+	if err := t.Send(protocol.MsgPartialReq, []byte(relPath)); err != nil {
+		return 0, err
+	}
+	var partial protocol.PartialInfo
+	mt, err := t.ReadJSON(&partial)
+	if err != nil {
+		return 0, err
+	}
+	if mt != protocol.MsgPartialInfo {
+		return 0, fmt.Errorf("expected partial info, got message type %v", mt)
+	}
+	if partial.Offset <= 0 {
+		return 0, nil
+	}
+
+	hash, err := pkgSync.CalculatePrefixHash(f, partial.Offset)
+	if err == nil && hash == partial.Hash {
+		return partial.Offset, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+)
+
+// session is an authenticated connection to the daemon. With CapMux the
+// connection is multiplexed, t is its control stream and files are
+// transferred on streams of their own.
+type session struct {
+	t       *protocol.Transport
+	mux     *protocol.Mux
+	exclude string
+	// mc is the per message compression of the session transports,
+	// nil without compression or with compression of the whole connection
+	mc *protocol.MessageCompression
+	// streams are the streams of the transports from transferStreams
+	streams []*protocol.Stream
+}
+
+// enableMessageCompression turns on the session's per message compression on t
+func (s *session) enableMessageCompression(t *protocol.Transport) error {
+	if s.mc == nil {
+		return nil
+	}
+	return t.EnableMessageCompression(*s.mc)
+}
+
+// transferStreams returns n streams to transfer files on concurrently.
+// Without multiplexing the control transport is the only one.
+func (s *session) transferStreams(n int) ([]*protocol.Transport, error) {
+	if s.mux == nil {
+		return []*protocol.Transport{s.t}, nil
+	}
+	// The control stream counts against the limit too
+	n = max(1, min(n, protocol.MaxStreams-1))
+	streams := make([]*protocol.Transport, 0, n)
+	for range n {
+		st, err := s.mux.Open()
+		if err != nil {
+			for _, st := range streams {
+				st.Close()
+			}
+			return nil, err
+		}
+		t := protocol.NewTransport(st)
+		if err := s.enableMessageCompression(t); err != nil {
+			st.Close()
+			for _, st := range streams {
+				st.Close()
+			}
+			return nil, err
+		}
+		streams = append(streams, t)
+		s.streams = append(s.streams, st)
+	}
+	return streams, nil
+}
+
+// closeStreams closes the streams returned by transferStreams. After a
+// failed transfer they are reset instead: requests may still be outstanding,
+// the daemon must not block answering them.
+func (s *session) closeStreams(streams []*protocol.Transport, failed bool) {
+	if s.mux == nil {
+		return
+	}
+	if failed {
+		for _, st := range s.streams {
+			st.Reset()
+		}
+	}
+	s.streams = nil
+	for _, st := range streams {
+		st.Close()
+	}
+}
+
+// close ends the session. A multiplexed connection is shut down gracefully,
+// so the daemon has processed everything sent before it returns.
+func (s *session) close() {
+	if s.mux != nil {
+		s.mux.Shutdown()
+		return
+	}
+	s.t.Close()
+}
+
+// runWorkers hands actions to one worker per stream and waits for them.
+// It returns the first error of a worker, which ends the transfer.
+func runWorkers(streams []*protocol.Transport, actions []pkgSync.FileAction, work func(t *protocol.Transport, actions <-chan pkgSync.FileAction, stop <-chan struct{}) error) error {
+	ch := make(chan pkgSync.FileAction)
+	stop := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, t := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := work(t, ch, stop); err != nil {
+				once.Do(func() {
+					firstErr = err
+					close(stop)
+				})
+			}
+		}()
+	}
+
+feed:
+	for _, a := range actions {
+		select {
+		case ch <- a:
+		case <-stop:
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// useTLS reports whether the connection should be wrapped in TLS.
+// Any TLS related option implies --tls.
+func (o Options) useTLS() bool {
+	return o.TLS || o.TLSCA != "" || o.TLSFingerprint != "" || o.TLSTOFU || o.TLSCert != ""
+}
+
+// clientTLSConfig builds the TLS config used to connect to info.
+// The server certificate is verified in one of three ways, in order of precedence:
+// a pinned fingerprint, trust on first use via the known hosts file, or the CA chain.
+func clientTLSConfig(info *RemoteInfo, opts Options) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: info.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	hostPort := net.JoinHostPort(info.Host, strconv.Itoa(info.Port))
+	switch {
+	case opts.TLSFingerprint != "":
+		pinned := utils.NormalizeFingerprint(opts.TLSFingerprint)
+		// The chain is not checked, the pinned fingerprint replaces it
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			got := utils.CertFingerprint(cs.PeerCertificates[0])
+			if got != pinned {
+				return fmt.Errorf("certificate fingerprint mismatch for %s: got SHA256:%s", hostPort, got)
+			}
+			return nil
+		}
+
+	case opts.TLSTOFU:
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			return verifyKnownHost(hostPort, utils.CertFingerprint(cs.PeerCertificates[0]))
+		}
+
+	case opts.TLSCA != "":
+		pool, err := utils.LoadCertPool(opts.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// knownHostsMu serializes access to the known hosts file between connections
+var knownHostsMu sync.Mutex
+
+func knownHostsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".fastsync", "known_hosts"), nil
+}
+
+// verifyKnownHost implements trust on first use. The first fingerprint seen
+// for a host is recorded, later connections must present the same one.
+func verifyKnownHost(hostPort, fingerprint string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	path, err := knownHostsPath()
+	if err != nil {
+		return err
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 || fields[0] != hostPort {
+				continue
+			}
+			f.Close()
+			if utils.NormalizeFingerprint(fields[1]) != fingerprint {
+				return fmt.Errorf("certificate of %s has changed (got SHA256:%s), remove its entry from %s if this is expected", hostPort, fingerprint, path)
+			}
+			return nil
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", hostPort, fingerprint); err != nil {
+		return err
+	}
+	logger.Warn("Trusting new certificate for %s (SHA256:%s)", hostPort, fingerprint)
+	return nil
+}
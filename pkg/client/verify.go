@@ -0,0 +1,147 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+	pkgSync "github.com/taurusxin/fastsync/pkg/sync"
+)
+
+// With CapVerify the sender of a file puts the MD5 of what it read into
+// MsgEndFile. The receiver checks its copy against it before moving it into
+// place and answers with MsgFileAck or MsgFileNack. Files that arrived
+// corrupted are transferred again after the others.
+
+// verifyRetries is how often files that arrived corrupted are sent again
+const verifyRetries = 2
+
+// retryList collects the files to transfer again
+type retryList struct {
+	mu      sync.Mutex
+	actions []pkgSync.FileAction
+}
+
+func (r *retryList) add(a pkgSync.FileAction) {
+	r.mu.Lock()
+	r.actions = append(r.actions, a)
+	r.mu.Unlock()
+}
+
+// take returns the collected files and empties the list
+func (r *retryList) take() []pkgSync.FileAction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	actions := r.actions
+	r.actions = nil
+	return actions
+}
+
+// transferVerified runs transfer for actions, then again for the files it
+// added to the retry list, up to verifyRetries times. Files still corrupted
+// then are added to failed. It returns the first error of transfer, which
+// ends the transfer.
+func transferVerified(actions []pkgSync.FileAction, failed *failures, transfer func(actions []pkgSync.FileAction, retry *retryList) error) error {
+	retry := &retryList{}
+	if err := transfer(actions, retry); err != nil {
+		return err
+	}
+	for range verifyRetries {
+		actions = retry.take()
+		if len(actions) == 0 {
+			return nil
+		}
+		logger.Warn("Transferring %d corrupted files again", len(actions))
+		if err := transfer(actions, retry); err != nil {
+			return err
+		}
+	}
+	for _, a := range retry.take() {
+		logger.Error("Giving up on %s, it was corrupted %d times", a.Path, verifyRetries+1)
+		failed.add(a.Path, pkgSync.ErrHashMismatch)
+	}
+	return nil
+}
+
+// sendAck answers a pulled file with MsgFileAck, or MsgFileNack if err is
+// set, if the daemon supports verification
+func sendAck(t *protocol.Transport, opts Options, relPath string, err error) error {
+	if !opts.daemonHas(protocol.CapVerify) {
+		return nil
+	}
+	if err == nil {
+		return t.Send(protocol.MsgFileAck, []byte(relPath))
+	}
+	return t.SendJSON(protocol.MsgFileNack, protocol.ErrorFor(relPath, err))
+}
+
+// pendingAcks are the pushed files or deletes the daemon hasn't answered yet.
+// The daemon answers in order, so the answers are read when they are due,
+// before other answers are expected and at the end, without waiting for each
+// file. Rejected files are added to failed, or to retry if the daemon
+// reported a retryable error.
+type pendingAcks struct {
+	t       *protocol.Transport
+	enabled bool
+	retry   *retryList
+	failed  *failures
+	files   []pkgSync.FileAction
+}
+
+// newPendingAcks returns the pending answers of t, which are only sent by
+// daemons with capability c
+func newPendingAcks(t *protocol.Transport, c string, opts Options, retry *retryList) *pendingAcks {
+	return &pendingAcks{t: t, enabled: opts.daemonHas(c), retry: retry, failed: opts.failed}
+}
+
+// add records a pushed file. If too many are pending, the oldest answer is read.
+func (p *pendingAcks) add(a pkgSync.FileAction) error {
+	if !p.enabled {
+		return nil
+	}
+	p.files = append(p.files, a)
+	if len(p.files) > pipelineDepth {
+		return p.readOne()
+	}
+	return nil
+}
+
+// drain reads all pending answers
+func (p *pendingAcks) drain() error {
+	for len(p.files) > 0 {
+		if err := p.readOne(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pendingAcks) readOne() error {
+	a := p.files[0]
+	p.files = p.files[1:]
+	mt, data, err := p.t.ReadData()
+	if err != nil {
+		return err
+	}
+	switch mt {
+	case protocol.MsgFileAck:
+		if string(data) != a.Path {
+			return fmt.Errorf("daemon acknowledged %s instead of %s", data, a.Path)
+		}
+	case protocol.MsgFileNack:
+		nack := protocol.DecodeError(data)
+		if nack.Path != a.Path {
+			return fmt.Errorf("daemon rejected %s instead of %s", nack.Path, a.Path)
+		}
+		logger.Error("Daemon rejected %s: %s (%s)", a.Path, nack.Message, nack.Code)
+		if nack.Retryable && p.retry != nil {
+			p.retry.add(a)
+		} else {
+			p.failed.add(a.Path, fmt.Errorf("remote error: %w", nack))
+		}
+	default:
+		return fmt.Errorf("unexpected message type %v", mt)
+	}
+	return nil
+}
@@ -1,36 +1,77 @@
 package config
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/taurusxin/fastsync/pkg/auth"
+	"github.com/taurusxin/fastsync/pkg/utils"
 )
 
 type Config struct {
-	Address   string           `toml:"address"`
-	Port      int              `toml:"port"`
-	LogLevel  string           `toml:"log_level"`
-	LogFile   string           `toml:"log_file"`
-	Instances []InstanceConfig `toml:"instances"`
+	Address                 string           `toml:"address"`
+	Port                    int              `toml:"port"`
+	LogLevel                string           `toml:"log_level"`
+	LogFile                 string           `toml:"log_file"`
+	TLSCert                 string           `toml:"tls_cert"`                   // PEM certificate, enables TLS
+	TLSKey                  string           `toml:"tls_key"`                    // PEM private key
+	TLSCA                   string           `toml:"tls_client_ca"`              // Require client certificates signed by this CA
+	BwLimit                 string           `toml:"bwlimit"`                    // Bandwidth of all connections together, see utils.ParseRateSchedule
+	HandshakeTimeout        int              `toml:"handshake_timeout"`          // Seconds a client has to authenticate, 0 for no limit
+	MaxHandshakes           int              `toml:"max_handshakes"`             // Connections authenticating at once, 0 for no limit
+	MaxConnections          int              `toml:"max_connections"`            // Connections of all instances together, 0 for no limit
+	MaxConnectionsPerIP     int              `toml:"max_connections_per_ip"`     // Connections of a client address, 0 for no limit
+	AuthMaxFailures         int              `toml:"auth_max_failures"`          // Failed passwords of a client address before it is banned, 0 for no limit
+	AuthMaxInstanceFailures int              `toml:"auth_max_instance_failures"` // Failed passwords on an instance before its logins are locked, 0 for no limit
+	AuthBanTime             int              `toml:"auth_ban_time"`              // Seconds of the first ban, every further one lasts twice as long
+	AuthMaxBanTime          int              `toml:"auth_max_ban_time"`          // Seconds of the longest ban, failures are forgotten after as long without one
+	Instances               []InstanceConfig `toml:"instances"`
 }
 
 type InstanceConfig struct {
 	Name           string `toml:"name"`
 	Path           string `toml:"path"`
 	Password       string `toml:"password"`
-	Exclude        string `toml:"exclude"` // Comma separated
-	MaxConnections int    `toml:"max_connections"`
-	HostAllow      string `toml:"host_allow"` // Comma separated
-	HostDeny       string `toml:"host_deny"`  // Comma separated
+	Exclude        string `toml:"exclude"`         // Comma separated
+	SkipCompress   string `toml:"skip_compress"`   // Comma separated extensions sent uncompressed
+	MaxConnections int    `toml:"max_connections"` // Connections of the instance, 0 for no limit
+	HostAllow      string `toml:"host_allow"`      // Comma separated
+	HostDeny       string `toml:"host_deny"`       // Comma separated
 	LogLevel       string `toml:"log_level"`
 	LogFile        string `toml:"log_file"`
+	BwLimit        string `toml:"bwlimit"`     // Bandwidth of the instance's connections together
+	Timeout        int    `toml:"timeout"`     // Seconds without data from a client before it's dropped, 0 for DefaultTimeout
+	MaxSession     int    `toml:"max_session"` // Seconds a connection may last, 0 for no limit
 }
 
+const (
+	// DefaultTimeout is the idle timeout of instances in seconds
+	DefaultTimeout = 300
+	// DefaultHandshakeTimeout is the time clients have to authenticate in seconds
+	DefaultHandshakeTimeout = 10
+	// DefaultMaxHandshakes is how many connections may authenticate at once
+	DefaultMaxHandshakes = 64
+	// DefaultAuthMaxFailures is how many failed passwords ban a client address
+	DefaultAuthMaxFailures = 5
+	// DefaultAuthBanTime is the first ban in seconds
+	DefaultAuthBanTime = 60
+	// DefaultAuthMaxBanTime is the longest ban in seconds
+	DefaultAuthMaxBanTime = 3600
+)
+
 func NewConfig() *Config {
 	return &Config{
 		Address:  "127.0.0.1",
 		Port:     7963,
 		LogLevel: "info",
+
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		MaxHandshakes:    DefaultMaxHandshakes,
+
+		AuthMaxFailures: DefaultAuthMaxFailures,
+		AuthBanTime:     DefaultAuthBanTime,
+		AuthMaxBanTime:  DefaultAuthMaxBanTime,
 	}
 }
 
@@ -45,6 +86,22 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if _, err := utils.ParseRateSchedule(cfg.BwLimit); err != nil {
+		return nil, fmt.Errorf("bwlimit: %w", err)
+	}
+	if cfg.HandshakeTimeout < 0 || cfg.MaxHandshakes < 0 {
+		return nil, fmt.Errorf("handshake_timeout and max_handshakes must not be negative")
+	}
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 {
+		return nil, fmt.Errorf("max_connections and max_connections_per_ip must not be negative")
+	}
+	if cfg.AuthMaxFailures < 0 || cfg.AuthMaxInstanceFailures < 0 || cfg.AuthBanTime < 0 {
+		return nil, fmt.Errorf("auth_max_failures, auth_max_instance_failures and auth_ban_time must not be negative")
+	}
+	if cfg.AuthMaxBanTime < cfg.AuthBanTime {
+		return nil, fmt.Errorf("auth_max_ban_time must not be less than auth_ban_time")
+	}
+
 	// Apply defaults for instances
 	for i := range cfg.Instances {
 		if cfg.Instances[i].Name == "" {
@@ -54,6 +111,25 @@ func LoadConfig(path string) (*Config, error) {
 			cfg.Instances[i].LogLevel = "info"
 		}
 		// LogFile defaults to stdout (empty string usually means stdout in our logic later)
+
+		// Password may be a hash, reject malformed ones early
+		if cfg.Instances[i].Password != "" {
+			if _, err := auth.ParseSecret(cfg.Instances[i].Password); err != nil {
+				return nil, fmt.Errorf("instance %s: %w", cfg.Instances[i].Name, err)
+			}
+		}
+		if _, err := utils.ParseRateSchedule(cfg.Instances[i].BwLimit); err != nil {
+			return nil, fmt.Errorf("instance %s: bwlimit: %w", cfg.Instances[i].Name, err)
+		}
+		if cfg.Instances[i].MaxConnections < 0 {
+			return nil, fmt.Errorf("instance %s: max_connections must not be negative", cfg.Instances[i].Name)
+		}
+		if cfg.Instances[i].Timeout < 0 || cfg.Instances[i].MaxSession < 0 {
+			return nil, fmt.Errorf("instance %s: timeout and max_session must not be negative", cfg.Instances[i].Name)
+		}
+		if cfg.Instances[i].Timeout == 0 {
+			cfg.Instances[i].Timeout = DefaultTimeout
+		}
 	}
 
 	return cfg, nil
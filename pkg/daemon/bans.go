@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/taurusxin/fastsync/pkg/config"
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/protocol"
+)
+
+// Failed passwords are counted per client address and per instance. When a
+// count reaches its limit, the address is banned or the instance's logins
+// are locked for the ban time, twice as long with every further ban up to
+// the longest ban time. A good login from an address clears its failures
+// since the last ban, but not its bans. Failures and bans are forgotten once
+// there was none for the longest ban time.
+
+// sweepInterval is how often entries that are forgotten get removed
+const sweepInterval = time.Minute
+
+// rejectBanned turns the client away if its address is banned or, unless
+// inst is nil, the logins of inst are locked. It reports whether it did.
+func (s *server) rejectBanned(t *protocol.Transport, ip string, inst *config.InstanceConfig) bool {
+	var msg string
+	if d := s.bannedIPs.banned(ip); d > 0 {
+		d = d.Round(time.Second)
+		msg = fmt.Sprintf("Too many failed logins, try again in %v", d)
+		logger.Warn("Rejected %s, it is banned for another %v", ip, d)
+	} else if inst == nil {
+		return false
+	} else if d := s.lockedInstances.banned(inst.Name); d > 0 {
+		d = d.Round(time.Second)
+		msg = fmt.Sprintf("Too many failed logins on the instance, try again in %v", d)
+		logger.Warn("Rejected %s, the logins of instance %s are locked for another %v", ip, inst.Name, d)
+	} else {
+		return false
+	}
+	t.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: msg})
+	return true
+}
+
+// banEntry is the record of an address or instance with failed passwords
+type banEntry struct {
+	failures int       // Failures since the last ban
+	bans     int       // Bans so far
+	until    time.Time // End of the current ban
+	last     time.Time // Last failure
+}
+
+// banList bans the keys that failed too often
+type banList struct {
+	maxFailures int // 0 for no bans
+	banTime     time.Duration
+	maxBanTime  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*banEntry
+	lastSweep time.Time
+}
+
+func newBanList(maxFailures int, banTime, maxBanTime time.Duration) *banList {
+	return &banList{
+		maxFailures: maxFailures,
+		banTime:     banTime,
+		maxBanTime:  maxBanTime,
+		entries:     make(map[string]*banEntry),
+	}
+}
+
+// banned returns how long key remains banned, 0 if it isn't
+func (b *banList) banned(key string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e := b.entries[key]; e != nil {
+		return max(time.Until(e.until), 0)
+	}
+	return 0
+}
+
+// fail counts a failure of key. It returns the ban it earned, 0 for none.
+func (b *banList) fail(key string) time.Duration {
+	if b.maxFailures == 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweep(now)
+
+	e := b.entries[key]
+	if e == nil || b.forgotten(e, now) {
+		e = &banEntry{}
+		b.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	if e.failures < b.maxFailures {
+		return 0
+	}
+
+	e.failures = 0
+	e.bans++
+	d := b.banTime
+	for i := 1; i < e.bans && d < b.maxBanTime; i++ {
+		d *= 2
+	}
+	d = min(d, b.maxBanTime)
+	e.until = now.Add(d)
+	return d
+}
+
+// succeed clears the failures of key since its last ban. The bans so far
+// still count, so a good login in between doesn't shorten the next ban.
+func (b *banList) succeed(key string) {
+	b.mu.Lock()
+	if e := b.entries[key]; e != nil {
+		e.failures = 0
+	}
+	b.mu.Unlock()
+}
+
+// sweep removes the entries that are forgotten, at most every sweepInterval
+func (b *banList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < sweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for key, e := range b.entries {
+		if b.forgotten(e, now) {
+			delete(b.entries, key)
+		}
+	}
+}
+
+// forgotten reports whether e's ban is over and its last failure too long ago
+func (b *banList) forgotten(e *banEntry, now time.Time) bool {
+	return now.After(e.until) && now.Sub(e.last) > b.maxBanTime
+}
@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanListBans(t *testing.T) {
+	b := newBanList(3, time.Minute, 5*time.Minute)
+	// Every ban takes maxFailures failures and lasts twice as long as the
+	// previous one, up to the longest ban time
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, ban := range want {
+		for j := 1; j < 3; j++ {
+			if d := b.fail("1.2.3.4"); d != 0 {
+				t.Fatalf("ban %d: failure %d banned for %v", i+1, j, d)
+			}
+		}
+		if d := b.fail("1.2.3.4"); d != ban {
+			t.Fatalf("ban %d lasts %v, want %v", i+1, d, ban)
+		}
+		if d := b.banned("1.2.3.4"); d <= ban-time.Second || d > ban {
+			t.Fatalf("ban %d: banned for another %v, want %v", i+1, d, ban)
+		}
+	}
+	if d := b.banned("5.6.7.8"); d != 0 {
+		t.Fatalf("other key banned for %v", d)
+	}
+}
+
+func TestBanListSucceed(t *testing.T) {
+	b := newBanList(2, time.Minute, time.Hour)
+	b.fail("a")
+	b.succeed("a")
+	if d := b.fail("a"); d != 0 {
+		t.Fatalf("failure after success banned for %v", d)
+	}
+	if d := b.fail("a"); d != time.Minute {
+		t.Fatalf("ban lasts %v, want %v", d, time.Minute)
+	}
+
+	// A success keeps the ban and its escalation
+	b.succeed("a")
+	if b.banned("a") == 0 {
+		t.Fatal("ban lifted by success")
+	}
+	b.fail("a")
+	if d := b.fail("a"); d != 2*time.Minute {
+		t.Fatalf("ban after success lasts %v, want %v", d, 2*time.Minute)
+	}
+	b.succeed("unknown")
+}
+
+func TestBanListDisabled(t *testing.T) {
+	b := newBanList(0, time.Minute, time.Hour)
+	for range 100 {
+		if d := b.fail("a"); d != 0 {
+			t.Fatalf("banned for %v without a failure limit", d)
+		}
+	}
+	if d := b.banned("a"); d != 0 {
+		t.Fatalf("banned for %v without a failure limit", d)
+	}
+}
+
+func TestBanListExpiry(t *testing.T) {
+	b := newBanList(2, time.Minute, time.Hour)
+	b.fail("a")
+	b.fail("a")
+	b.fail("b")
+
+	// Move the ban of a into the past
+	old := time.Now().Add(-2 * time.Hour)
+	b.entries["a"].until = old.Add(time.Minute)
+	b.entries["a"].last = old
+	if d := b.banned("a"); d != 0 {
+		t.Fatalf("expired ban lasts another %v", d)
+	}
+
+	// Once forgotten, the bans start over at the shortest ban time
+	b.fail("a")
+	if d := b.fail("a"); d != time.Minute {
+		t.Fatalf("ban after expiry lasts %v, want %v", d, time.Minute)
+	}
+
+	// Sweeping removes forgotten entries only
+	b.entries["a"].until = old.Add(time.Minute)
+	b.entries["a"].last = old
+	b.lastSweep = old
+	b.fail("c")
+	if _, ok := b.entries["a"]; ok {
+		t.Fatal("forgotten entry not swept")
+	}
+	if _, ok := b.entries["b"]; !ok {
+		t.Fatal("recent entry swept")
+	}
+}
@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/taurusxin/fastsync/pkg/config"
+)
+
+// Authenticated connections are counted per instance, per client address
+// and for the whole daemon. A client over any of the limits is turned away
+// after authenticating. The connections of chunked transfers count as well.
+
+// conns are the authenticated connections of the daemon
+type conns struct {
+	total     int
+	ips       map[string]int
+	instances map[string]int
+}
+
+// acquireConn counts a connection of ip to inst, unless it exceeds a limit.
+// The connection must be released with releaseConn.
+func (s *server) acquireConn(ip string, inst *config.InstanceConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.cfg.MaxConnections > 0 && s.conns.total >= s.cfg.MaxConnections:
+		return fmt.Errorf("the daemon allows %d", s.cfg.MaxConnections)
+	case inst.MaxConnections > 0 && s.conns.instances[inst.Name] >= inst.MaxConnections:
+		return fmt.Errorf("instance %s allows %d", inst.Name, inst.MaxConnections)
+	case s.cfg.MaxConnectionsPerIP > 0 && s.conns.ips[ip] >= s.cfg.MaxConnectionsPerIP:
+		return fmt.Errorf("%d per client address are allowed", s.cfg.MaxConnectionsPerIP)
+	}
+	s.conns.total++
+	s.conns.instances[inst.Name]++
+	s.conns.ips[ip]++
+	return nil
+}
+
+func (s *server) releaseConn(ip string, inst *config.InstanceConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns.total--
+	s.conns.instances[inst.Name]--
+	if s.conns.instances[inst.Name] == 0 {
+		delete(s.conns.instances, inst.Name)
+	}
+	s.conns.ips[ip]--
+	if s.conns.ips[ip] == 0 {
+		delete(s.conns.ips, ip)
+	}
+}
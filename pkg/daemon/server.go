@@ -1,7 +1,11 @@
 package daemon
 
 import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +17,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/taurusxin/fastsync/pkg/auth"
 	"github.com/taurusxin/fastsync/pkg/config"
 	"github.com/taurusxin/fastsync/pkg/logger"
 	"github.com/taurusxin/fastsync/pkg/protocol"
@@ -29,14 +34,30 @@ func Run(cfg *config.Config) {
 		}
 	}
 
+	lims, err := newLimiters(cfg)
+	if err != nil {
+		logger.Error("Invalid bandwidth limit: %v", err)
+		return
+	}
+
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		logger.Error("Failed to load TLS certificate: %v", err)
+		return
+	}
+
 	addr := fmt.Sprintf("%s:%d", cfg.Address, cfg.Port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		logger.Error("Failed to bind %s: %v", addr, err)
 		return
 	}
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
 	logger.Info("Listening on %s", addr)
 
+	srv := newServer(cfg, lims)
 	var wg sync.WaitGroup
 	go func() {
 		for {
@@ -49,10 +70,15 @@ func Run(cfg *config.Config) {
 				logger.Error("Accept error: %v", err)
 				continue
 			}
+			if !srv.beginHandshake() {
+				logger.Warn("Too many clients authenticating, dropped %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				handleConn(conn, cfg)
+				srv.handleConn(conn)
 			}()
 		}
 	}()
@@ -69,35 +95,125 @@ func Run(cfg *config.Config) {
 	logger.Info("Server stopped gracefully")
 }
 
-func handleConn(conn net.Conn, cfg *config.Config) {
+// limiters are the bandwidth limits shared by the daemon's connections
+type limiters struct {
+	global    *utils.RateLimiter
+	instances map[string]*utils.RateLimiter
+}
+
+func newLimiters(cfg *config.Config) (*limiters, error) {
+	global, err := utils.NewRateLimiter(cfg.BwLimit)
+	if err != nil {
+		return nil, err
+	}
+	lims := &limiters{global: global, instances: make(map[string]*utils.RateLimiter)}
+	for _, inst := range cfg.Instances {
+		l, err := utils.NewRateLimiter(inst.BwLimit)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+		lims.instances[inst.Name] = l
+	}
+	return lims, nil
+}
+
+// server is the state shared by the daemon's connections
+type server struct {
+	cfg  *config.Config
+	lims *limiters
+	// handshakes has a slot for each connection that hasn't authenticated
+	// yet, nil for no limit
+	handshakes chan struct{}
+
+	mu    sync.Mutex
+	conns conns
+
+	// Client addresses and instances with too many failed passwords
+	bannedIPs       *banList
+	lockedInstances *banList
+}
+
+func newServer(cfg *config.Config, lims *limiters) *server {
+	s := &server{cfg: cfg, lims: lims}
+	s.conns.ips = make(map[string]int)
+	s.conns.instances = make(map[string]int)
+	banTime := time.Duration(cfg.AuthBanTime) * time.Second
+	maxBanTime := time.Duration(cfg.AuthMaxBanTime) * time.Second
+	s.bannedIPs = newBanList(cfg.AuthMaxFailures, banTime, maxBanTime)
+	s.lockedInstances = newBanList(cfg.AuthMaxInstanceFailures, banTime, maxBanTime)
+	if cfg.MaxHandshakes > 0 {
+		s.handshakes = make(chan struct{}, cfg.MaxHandshakes)
+	}
+	return s
+}
+
+// beginHandshake takes a handshake slot for a new connection. It reports
+// false if all are taken.
+func (s *server) beginHandshake() bool {
+	if s.handshakes == nil {
+		return true
+	}
+	select {
+	case s.handshakes <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// endHandshake frees the slot of a connection that authenticated or failed to
+func (s *server) endHandshake() {
+	if s.handshakes != nil {
+		<-s.handshakes
+	}
+}
+
+// handleConn serves a connection that holds a handshake slot
+func (s *server) handleConn(conn net.Conn) {
+	// Until the client authenticated, it holds a handshake slot and has to
+	// finish in time. Nothing is allocated for the instance before that.
+	handshaking := true
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("Recovered from panic in handleConn: %v", r)
 		}
+		if handshaking {
+			s.endHandshake()
+		}
 		conn.Close()
 	}()
 	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if s.cfg.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(s.cfg.HandshakeTimeout) * time.Second))
+	}
 
 	transport := protocol.NewTransport(conn)
 
 	// 1. Auth
 	var authReq protocol.AuthRequest
-	msgType, err := transport.ReadJSON(&authReq)
+	if err := readHandshake(transport, protocol.MsgAuthReq, &authReq); err != nil {
+		logger.Warn("Dropped handshake of %s: %v", remoteIP, err)
+		return
+	}
+
+	version, err := protocol.NegotiateVersion(authReq.Version)
 	if err != nil {
-		logger.Error("Failed to read auth: %v", err)
+		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: err.Error()})
+		logger.Warn("Rejected client %s: %v", remoteIP, err)
 		return
 	}
-	if msgType != protocol.MsgAuthReq {
-		logger.Error("Unexpected message type: %v", msgType)
+	caps := protocol.NegotiateCapabilities(protocol.Capabilities(), authReq.Capabilities)
+
+	if s.rejectBanned(transport, remoteIP, nil) {
 		return
 	}
 
 	// Validate Instance
 	var instance *config.InstanceConfig
 	found := false
-	for i := range cfg.Instances {
-		if cfg.Instances[i].Name == authReq.Instance {
-			instance = &cfg.Instances[i]
+	for i := range s.cfg.Instances {
+		if s.cfg.Instances[i].Name == authReq.Instance {
+			instance = &s.cfg.Instances[i]
 			found = true
 			break
 		}
@@ -105,9 +221,52 @@ func handleConn(conn net.Conn, cfg *config.Config) {
 
 	if !found {
 		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Instance not found"})
+		logger.Warn("Client %s asked for unknown instance %q", remoteIP, authReq.Instance)
+		return
+	}
+
+	if !utils.CheckAccess(remoteIP, instance.HostAllow, instance.HostDeny) {
+		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Access denied"})
+		logger.Warn("Access denied for %s on instance %s", remoteIP, instance.Name)
 		return
 	}
 
+	var serverProof []byte
+	if instance.Password != "" {
+		if s.rejectBanned(transport, remoteIP, instance) {
+			return
+		}
+		var ok bool
+		ok, serverProof, err = challenge(transport, instance)
+		if err != nil {
+			logger.Warn("Dropped handshake of %s on instance %s: %v", remoteIP, instance.Name, err)
+			return
+		}
+		if !ok {
+			transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Invalid password"})
+			logger.Warn("Invalid password for %s on instance %s", remoteIP, instance.Name)
+			if d := s.bannedIPs.fail(remoteIP); d > 0 {
+				logger.Warn("Banned %s for %v after %d failed passwords", remoteIP, d, s.cfg.AuthMaxFailures)
+			}
+			if d := s.lockedInstances.fail(instance.Name); d > 0 {
+				logger.Warn("Locked the logins of instance %s for %v after %d failed passwords", instance.Name, d, s.cfg.AuthMaxInstanceFailures)
+			}
+			return
+		}
+		// Guesses that were in flight when the ban began fail all the same
+		if s.rejectBanned(transport, remoteIP, instance) {
+			return
+		}
+		s.bannedIPs.succeed(remoteIP)
+	}
+
+	if err := s.acquireConn(remoteIP, instance); err != nil {
+		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Too many connections: " + err.Error()})
+		logger.Warn("Too many connections for %s on instance %s: %v", remoteIP, instance.Name, err)
+		return
+	}
+	defer s.releaseConn(remoteIP, instance)
+
 	// Initialize Instance Logger
 	var logOut io.Writer = os.Stdout
 	if instance.LogFile != "" && instance.LogFile != "stdout" {
@@ -122,40 +281,233 @@ func handleConn(conn net.Conn, cfg *config.Config) {
 	}
 	instLogger := logger.New(logOut, logger.ParseLevel(instance.LogLevel), instance.Name)
 
-	if !utils.CheckAccess(remoteIP, instance.HostAllow, instance.HostDeny) {
-		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Access denied"})
-		instLogger.Warn("Access denied for %s on instance %s", remoteIP, instance.Name)
+	// Only per message compression is supported
+	var compression string
+	var level int
+	if authReq.Compression != "" && protocol.HasCapability(caps, protocol.CapCompressMsgs) {
+		var algo string
+		if algo, level, err = protocol.ParseCompression(authReq.Compression); err != nil {
+			level = 0
+		}
+		compression = protocol.ChooseCompression(algo, caps)
+		if compression != algo {
+			level = 0
+		}
+	}
+
+	err = transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{
+		Success:      true,
+		Exclude:      instance.Exclude,
+		SkipCompress: protocol.ParseExtensions(instance.SkipCompress),
+		Version:      version,
+		Capabilities: caps,
+		Compression:  compression,
+		IdleTimeout:  instance.Timeout,
+		ServerProof:  serverProof,
+	})
+	if err != nil {
+		instLogger.Warn("Dropped handshake of %s: %v", remoteIP, err)
 		return
 	}
+	instLogger.Info("Client %s connected", remoteIP)
+	conn.SetDeadline(time.Time{})
+	s.endHandshake()
+	handshaking = false
+
+	// Dead clients are dropped once they sent nothing for the idle timeout,
+	// live ones send heartbeats while they are busy
+	transport.SetIdleTimeout(time.Duration(instance.Timeout) * time.Second)
+	if instance.MaxSession > 0 {
+		maxSession := time.Duration(instance.MaxSession) * time.Second
+		timer := time.AfterFunc(maxSession, func() {
+			instLogger.Warn("Closing the connection of %s, it exceeded the maximum session duration of %v", remoteIP, maxSession)
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	transport.LimitRate(s.lims.global, s.lims.instances[instance.Name])
 
-	if instance.Password != "" && instance.Password != authReq.Password {
-		transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{Success: false, Message: "Invalid password"})
-		instLogger.Warn("Invalid password for %s on instance %s", remoteIP, instance.Name)
+	// Per message compression applies to the sessions, on a multiplexed
+	// connection to each stream instead of the connection itself
+	var mc *protocol.MessageCompression
+	if compression != "" {
+		mc = &protocol.MessageCompression{
+			Algo:  compression,
+			Level: level,
+			Skip:  append(protocol.ParseExtensions(instance.SkipCompress), authReq.SkipCompress...),
+		}
+	}
+
+	if protocol.HasCapability(caps, protocol.CapHeartbeat) {
+		transport.StartHeartbeat(time.Duration(authReq.IdleTimeout) * time.Second)
+	}
+
+	if protocol.HasCapability(caps, protocol.CapMux) {
+		serveStreams(transport, instance, caps, mc, instLogger)
+		return
+	}
+	if err := enableMessageCompression(transport, mc); err != nil {
+		instLogger.Error("Failed to enable compression: %v", err)
 		return
 	}
+	handleSession(transport, instance, caps, instLogger)
+}
 
-	transport.SendJSON(protocol.MsgAuthResp, protocol.AuthResponse{
-		Success: true,
-		Exclude: instance.Exclude,
-	})
-	instLogger.Info("Client %s connected", remoteIP)
+// enableMessageCompression turns on per message compression of a session
+// transport, if it was negotiated
+func enableMessageCompression(t *protocol.Transport, mc *protocol.MessageCompression) error {
+	if mc == nil {
+		return nil
+	}
+	return t.EnableMessageCompression(*mc)
+}
 
-	// Set initial read deadline for the handshake/command loop
-	// We'll update it during large transfers if needed, but keeping a deadline
-	// prevents dead connections.
-	conn.SetDeadline(time.Now().Add(1 * time.Hour))
+// serveStreams runs a session on every stream of a multiplexed connection.
+// The session on the control stream ends the connection, after the sessions
+// on the other streams have finished.
+func serveStreams(t *protocol.Transport, inst *config.InstanceConfig, caps []string, mc *protocol.MessageCompression, log *logger.Logger) {
+	mux := protocol.NewMux(t, false)
 
-	if authReq.Compress {
-		if err := transport.EnableCompression(); err != nil {
-			instLogger.Error("Failed to enable compression: %v", err)
-			return
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	closing := false
+	go func() {
+		for {
+			s, err := mux.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if closing {
+				mu.Unlock()
+				s.Close()
+				continue
+			}
+			wg.Add(1)
+			mu.Unlock()
+
+			go func() {
+				defer wg.Done()
+				st := protocol.NewTransport(s)
+				if err := enableMessageCompression(st, mc); err != nil {
+					log.Error("Failed to enable compression: %v", err)
+				} else {
+					handleSession(st, inst, caps, log)
+				}
+				st.Close()
+				// Nothing reads the stream anymore, a client still
+				// writing to it must not wait for credit
+				s.Reset()
+			}()
 		}
+	}()
+
+	control := protocol.NewTransport(mux.Control())
+	if err := enableMessageCompression(control, mc); err != nil {
+		log.Error("Failed to enable compression: %v", err)
+	} else {
+		handleSession(control, inst, caps, log)
 	}
+	control.Close()
 
-	handleSession(transport, instance, instLogger)
+	mu.Lock()
+	closing = true
+	mu.Unlock()
+	wg.Wait()
 }
 
-func handleSession(t *protocol.Transport, inst *config.InstanceConfig, log *logger.Logger) {
+// sendFileList sends files in batches of FileListBatchSize, followed by
+// MsgFileListEnd. A scan error is reported to the client with MsgError.
+// Batches are JSON unless binary is set.
+func sendFileList(t *protocol.Transport, caps []string, files pkgSync.FileIter, binary bool) error {
+	send := func(batch []protocol.FileInfo) error {
+		if !binary {
+			return t.SendJSON(protocol.MsgFileList, batch)
+		}
+		data, err := protocol.EncodeFileList(batch)
+		if err != nil {
+			return err
+		}
+		return t.Send(protocol.MsgFileList, data)
+	}
+
+	batch := make([]protocol.FileInfo, 0, protocol.FileListBatchSize)
+	for fi, err := range files {
+		if err != nil {
+			sendError(t, caps, "", err)
+			return err
+		}
+		batch = append(batch, fi)
+		if len(batch) == protocol.FileListBatchSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := send(batch); err != nil {
+			return err
+		}
+	}
+	return t.Send(protocol.MsgFileListEnd, nil)
+}
+
+// maxHandshakeSize limits the messages of clients that haven't
+// authenticated, they are far smaller than protocol.MaxMessageSize
+const maxHandshakeSize = 64 * 1024
+
+// readHandshake reads the handshake message of type want into v
+func readHandshake(t *protocol.Transport, want protocol.MessageType, v any) error {
+	mt, length, err := t.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if mt != want {
+		return fmt.Errorf("unexpected message type: %v", mt)
+	}
+	if length > maxHandshakeSize {
+		return fmt.Errorf("handshake message too large: %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// challenge sends a random nonce and checks the client's proof of it
+// against the instance password. If it matches, it returns the daemon's
+// proof for the client. Errors are protocol failures.
+func challenge(t *protocol.Transport, inst *config.InstanceConfig) (bool, []byte, error) {
+	secret, err := auth.ParseSecret(inst.Password)
+	if err != nil {
+		return false, nil, err
+	}
+	nonce, err := auth.NewNonce()
+	if err != nil {
+		return false, nil, err
+	}
+	ch := protocol.AuthChallenge{Nonce: nonce, Setting: secret.Setting}
+	if secret.Setting != "" {
+		ch.KeyLen = auth.KeyLen
+	}
+	if err := t.SendJSON(protocol.MsgAuthChallenge, ch); err != nil {
+		return false, nil, err
+	}
+
+	var proof protocol.AuthProof
+	if err := readHandshake(t, protocol.MsgAuthProof, &proof); err != nil {
+		return false, nil, err
+	}
+	if !auth.Verify(secret, nonce, inst.Name, proof.Proof) {
+		return false, nil, nil
+	}
+	return true, auth.ServerProof(secret, nonce, inst.Name), nil
+}
+
+func handleSession(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Error("Recovered from panic in handleSession: %v", r)
@@ -166,7 +518,9 @@ func handleSession(t *protocol.Transport, inst *config.InstanceConfig, log *logg
 	for {
 		msgType, length, err := t.ReadHeader()
 		if err != nil {
-			if err != io.EOF {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Warn("Connection timed out")
+			} else if err != io.EOF {
 				log.Error("Read error: %v", err)
 			}
 			return
@@ -187,12 +541,21 @@ func handleSession(t *protocol.Transport, inst *config.InstanceConfig, log *logg
 				}
 			}
 
-			files, err := pkgSync.Scan(inst.Path, strings.Split(inst.Exclude, ","), req.Checksum)
+			excludes := strings.Split(inst.Exclude, ",")
+			if protocol.HasCapability(caps, protocol.CapFileList) {
+				binary := protocol.HasCapability(caps, protocol.CapFileListBinary)
+				if err := sendFileList(t, caps, pkgSync.Walk(inst.Path, excludes, req.Checksum), binary); err != nil {
+					log.Error("Failed to send file list: %v", err)
+					return
+				}
+				continue
+			}
+
+			// Clients without CapFileList expect the whole list in one message
+			files, err := pkgSync.Scan(inst.Path, excludes, req.Checksum)
 			if err != nil {
 				log.Error("Scan failed: %v", err)
-				t.SendJSON(protocol.MsgError, protocol.AuthResponse{Message: err.Error()}) // Reuse struct? No, map[string]string?
-				// Just send error type with simple string
-				t.Send(protocol.MsgError, []byte(err.Error()))
+				sendError(t, caps, "", err)
 				return
 			}
 			t.SendJSON(protocol.MsgFileList, files)
@@ -201,120 +564,213 @@ func handleSession(t *protocol.Transport, inst *config.InstanceConfig, log *logg
 			// Client wants file
 			pathData := make([]byte, length)
 			io.ReadFull(t.GetConn(), pathData)
-			relPath := string(pathData)
+			if err := sendFile(t, inst, caps, log, string(pathData), nil, buf); err != nil {
+				log.Error("Send failed for %s: %v", pathData, err)
+				return
+			}
+
+		case protocol.MsgResumeReq:
+			// Client wants the rest of a file it has partially received
+			data := make([]byte, length)
+			if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+				log.Error("Failed to read resume request: %v", err)
+				return
+			}
+			var resume protocol.PartialInfo
+			if err := json.Unmarshal(data, &resume); err != nil {
+				log.Error("Failed to unmarshal resume request: %v", err)
+				return
+			}
+			if err := sendFile(t, inst, caps, log, resume.Path, &resume, buf); err != nil {
+				log.Error("Send failed for %s: %v", resume.Path, err)
+				return
+			}
+
+		case protocol.MsgPartialReq:
+			// Client asks what is left of an interrupted push
+			pathData := make([]byte, length)
+			if _, err := io.ReadFull(t.GetConn(), pathData); err != nil {
+				log.Error("Failed to read partial request: %v", err)
+				return
+			}
+			partial := protocol.PartialInfo{Path: string(pathData)}
+			if absPath, err := utils.SecureJoin(inst.Path, partial.Path); err == nil {
+				if hash, size, err := hashPartial(utils.PartialPath(absPath)); err == nil && size > 0 {
+					partial.Offset = size
+					partial.Hash = hash
+				}
+			}
+			t.SendJSON(protocol.MsgPartialInfo, partial)
+
+		case protocol.MsgStartFile:
+			// Client sending file
+			var startMsg protocol.StartFileMsg
+			if err := readJSON(t, length, &startMsg); err != nil {
+				log.Error("Failed to read start file: %v", err)
+				return
+			}
+			if err := receiveFile(t, inst, caps, log, startMsg); err != nil {
+				log.Error("Receive failed for %s: %v", startMsg.Path, err)
+				return
+			}
+
+		case protocol.MsgFileAck:
+			// The client verified a pulled file
+			if _, err := io.CopyN(io.Discard, t.GetConn(), int64(length)); err != nil {
+				log.Error("Failed to read file ack: %v", err)
+				return
+			}
+
+		case protocol.MsgFileNack:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+				log.Error("Failed to read file nack: %v", err)
+				return
+			}
+			nack := protocol.DecodeError(data)
+			log.Warn("Client rejected %s: %s (%s)", nack.Path, nack.Message, nack.Code)
+
+		case protocol.MsgDeltaReq:
+			// Client wants the difference to a file it already has
+			data := make([]byte, length)
+			if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+				log.Error("Failed to read delta request: %v", err)
+				return
+			}
+			relPath, sigData, err := protocol.DecodeDeltaReq(data)
+			if err != nil {
+				log.Error("Invalid delta request: %v", err)
+				return
+			}
+			var sig pkgSync.Signature
+			if err := sig.UnmarshalBinary(sigData); err != nil {
+				log.Error("Invalid signature for %s: %v", relPath, err)
+				sendError(t, caps, relPath, protocol.NewError(protocol.ErrCodeInvalidRequest, err.Error()))
+				continue
+			}
 
 			absPath, err := utils.SecureJoin(inst.Path, relPath)
 			if err != nil {
 				log.Error("Security error: %v", err)
-				t.Send(protocol.MsgError, []byte("Invalid path"))
+				sendError(t, caps, relPath, errInvalidPath)
 				continue
 			}
 
 			f, err := os.Open(absPath)
 			if err != nil {
 				log.Error("Open file error: %v", err)
-				t.Send(protocol.MsgError, []byte(err.Error()))
+				sendError(t, caps, relPath, err)
 				continue
 			}
-
 			info, _ := f.Stat()
+			if info.IsDir() {
+				f.Close()
+				sendError(t, caps, relPath, errNotRegular)
+				continue
+			}
+
 			t.SendJSON(protocol.MsgStartFile, protocol.StartFileMsg{
 				Path:    relPath,
 				Size:    info.Size(),
 				Mode:    uint32(info.Mode()),
 				ModTime: info.ModTime().Unix(),
+				Delta:   true,
 			})
-			log.Info("Sending file: %s", relPath)
-
-			if info.IsDir() {
-				f.Close()
-				t.Send(protocol.MsgEndFile, nil)
-				continue
-			}
+			log.Info("Sending delta: %s", relPath)
 
-			// Send chunks
-			for {
-				n, err := f.Read(buf)
-				if n > 0 {
-					t.Send(protocol.MsgData, buf[:n])
-				}
-				if err != nil {
-					break
-				}
-			}
+			h := md5.New()
+			err = pkgSync.ComputeDelta(io.TeeReader(f, h), &sig, func(op pkgSync.DeltaOp) error {
+				data, _ := op.MarshalBinary()
+				return t.Send(protocol.MsgDelta, data)
+			})
 			f.Close()
-			t.Send(protocol.MsgEndFile, nil)
-
-		case protocol.MsgStartFile:
-			// Client sending file
-			data := make([]byte, length)
-			io.ReadFull(t.GetConn(), data)
-			var startMsg protocol.StartFileMsg
-			json.Unmarshal(data, &startMsg)
-
-			absPath, err := utils.SecureJoin(inst.Path, startMsg.Path)
 			if err != nil {
-				log.Error("Security error: %v", err)
-				// Skip until EndFile
-				discardFile(t)
-				continue
+				log.Error("Delta send failed for %s: %v", relPath, err)
+				return
 			}
-
-			// Ensure dir exists
-			os.MkdirAll(filepath.Dir(absPath), 0755)
-
-			if os.FileMode(startMsg.Mode).IsDir() {
-				os.MkdirAll(absPath, 0755) // Ignore mode for now or use startMsg.Mode
-				discardFile(t)
-				continue
+			var hash []byte
+			if protocol.HasCapability(caps, protocol.CapVerify) {
+				hash = []byte(hex.EncodeToString(h.Sum(nil)))
+			}
+			if err := t.Send(protocol.MsgEndFile, hash); err != nil {
+				log.Error("Delta send failed for %s: %v", relPath, err)
+				return
 			}
 
-			f, err := os.OpenFile(absPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(startMsg.Mode))
+		case protocol.MsgDeleteFile:
+			pathData := make([]byte, length)
+			if _, err := io.ReadFull(t.GetConn(), pathData); err != nil {
+				log.Error("Failed to read delete request: %v", err)
+				return
+			}
+			relPath := string(pathData)
+			err := deleteFile(inst, relPath)
 			if err != nil {
-				log.Error("Create file error: %v", err)
-				discardFile(t)
-				continue
+				log.Error("Failed to delete %s: %v", relPath, err)
+			} else {
+				log.Info("Deleted %s", relPath)
 			}
-
-			// Read Data until EndFile
-			for {
-				mt, l, err := t.ReadHeader()
-				if err != nil {
-					f.Close()
-					return
-				}
-				if mt == protocol.MsgEndFile {
-					break
-				}
-				if mt == protocol.MsgData {
-					io.CopyN(f, t.GetConn(), int64(l))
-				} else {
-					// Unexpected
-					f.Close()
+			if protocol.HasCapability(caps, protocol.CapResults) {
+				if err := sendResult(t, relPath, err); err != nil {
+					log.Error("Failed to send delete result: %v", err)
 					return
 				}
 			}
-			f.Close()
 
-			// Restore attributes
-			if startMsg.ModTime > 0 {
-				os.Chtimes(absPath, time.Unix(startMsg.ModTime, 0), time.Unix(startMsg.ModTime, 0))
+		case protocol.MsgRangeReq:
+			// Client pulls one range of a chunked transfer
+			var r protocol.RangeMsg
+			if err := readJSON(t, length, &r); err != nil {
+				log.Error("Failed to read range request: %v", err)
+				return
 			}
-			if startMsg.Mode > 0 {
-				os.Chmod(absPath, os.FileMode(startMsg.Mode))
+			if err := sendRange(t, inst, caps, log, r, buf); err != nil {
+				log.Error("Range send failed for %s: %v", r.Path, err)
+				return
 			}
 
-			log.Info("Received file: %s", startMsg.Path)
+		case protocol.MsgRangeStart:
+			// Client pushes one range of a chunked transfer
+			var r protocol.RangeMsg
+			if err := readJSON(t, length, &r); err != nil {
+				log.Error("Failed to read range: %v", err)
+				return
+			}
+			if err := receiveRange(t, inst, caps, log, r); err != nil {
+				log.Error("Range receive failed for %s: %v", r.Path, err)
+				return
+			}
 
-		case protocol.MsgDeleteFile:
+		case protocol.MsgRangeCommit:
+			var c protocol.RangeCommit
+			if err := readJSON(t, length, &c); err != nil {
+				log.Error("Failed to read range commit: %v", err)
+				return
+			}
+			commitRanges(t, inst, caps, log, c)
+
+		case protocol.MsgHashReq:
 			pathData := make([]byte, length)
-			io.ReadFull(t.GetConn(), pathData)
+			if _, err := io.ReadFull(t.GetConn(), pathData); err != nil {
+				log.Error("Failed to read hash request: %v", err)
+				return
+			}
 			relPath := string(pathData)
 			absPath, err := utils.SecureJoin(inst.Path, relPath)
+			var info os.FileInfo
 			if err == nil {
-				os.Remove(absPath) // Or RemoveAll?
-				log.Info("Deleted %s", relPath)
+				info, err = os.Stat(absPath)
+			}
+			var hash string
+			if err == nil {
+				hash, err = pkgSync.CalculateHash(absPath)
+			}
+			if err != nil {
+				log.Error("Hash error for %s: %v", relPath, err)
+				sendError(t, caps, relPath, err)
+				continue
 			}
+			t.SendJSON(protocol.MsgHashInfo, protocol.FileHash{Path: relPath, Size: info.Size(), Hash: hash})
 
 		case protocol.MsgDone:
 			return
@@ -322,15 +778,448 @@ func handleSession(t *protocol.Transport, inst *config.InstanceConfig, log *logg
 	}
 }
 
-func discardFile(t *protocol.Transport) {
+// readJSON reads a message payload of length bytes into v
+func readJSON(t *protocol.Transport, length uint32, v any) error {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(t.GetConn(), data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// sendRange answers a range request with the range as MsgData and EndFile.
+// The data ends early if the file is shorter, which the client detects.
+// Only transport errors are returned.
+func sendRange(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger, r protocol.RangeMsg, buf []byte) error {
+	absPath, err := utils.SecureJoin(inst.Path, r.Path)
+	if err != nil {
+		log.Error("Security error: %v", err)
+		return sendError(t, caps, r.Path, errInvalidPath)
+	}
+	f, err := os.Open(absPath)
+	var info os.FileInfo
+	if err == nil {
+		defer f.Close()
+		info, err = f.Stat()
+	}
+	if err == nil && (r.Offset < 0 || r.Length < 0) {
+		err = protocol.NewError(protocol.ErrCodeInvalidRequest, fmt.Sprintf("invalid range %d+%d", r.Offset, r.Length))
+	}
+	if err == nil {
+		_, err = f.Seek(r.Offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Error("Range error for %s: %v", r.Path, err)
+		return sendError(t, caps, r.Path, err)
+	}
+
+	n := max(0, min(r.Length, info.Size()-r.Offset))
+	t.BeginFile(r.Path)
+	if err := t.SendFile(f, n, buf); err != nil {
+		return err
+	}
+	return t.Send(protocol.MsgEndFile, nil)
+}
+
+// receiveRange writes a pushed range at its offset into the temp file of the
+// destination and acknowledges it with MsgRangeDone, or MsgError if it
+// couldn't be written. Only transport errors are returned.
+func receiveRange(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger, r protocol.RangeMsg) error {
+	absPath, err := utils.SecureJoin(inst.Path, r.Path)
+	if err != nil {
+		err = errInvalidPath
+	}
+	if err == nil && (r.Offset < 0 || r.Length < 0) {
+		err = protocol.NewError(protocol.ErrCodeInvalidRequest, fmt.Sprintf("invalid range %d+%d", r.Offset, r.Length))
+	}
+	var f *os.File
+	if err == nil {
+		os.MkdirAll(filepath.Dir(absPath), 0755)
+		// Other connections write their ranges into the same file, so it's not truncated
+		f, err = os.OpenFile(utils.TempPath(absPath), os.O_CREATE|os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		log.Error("Range error for %s: %v", r.Path, err)
+		if discardErr := t.DiscardFile(); discardErr != nil {
+			return discardErr
+		}
+		return sendError(t, caps, r.Path, err)
+	}
+
+	pos, end := r.Offset, r.Offset+r.Length
+	var writeErr error
 	for {
-		mt, l, err := t.ReadHeader()
+		mt, data, err := t.ReadData()
 		if err != nil {
-			return
+			f.Close()
+			return err
 		}
 		if mt == protocol.MsgEndFile {
-			return
+			break
 		}
-		io.CopyN(io.Discard, t.GetConn(), int64(l))
+		if mt != protocol.MsgData {
+			f.Close()
+			return fmt.Errorf("unexpected message type %v", mt)
+		}
+		if writeErr == nil && pos+int64(len(data)) > end {
+			writeErr = protocol.NewError(protocol.ErrCodeInvalidRequest, fmt.Sprintf("data exceeds range %d+%d", r.Offset, r.Length))
+		}
+		if writeErr == nil {
+			_, writeErr = f.WriteAt(data, pos)
+		}
+		pos += int64(len(data))
+	}
+	if err := f.Close(); writeErr == nil {
+		writeErr = err
+	}
+	if writeErr != nil {
+		log.Error("Range write failed for %s: %v", r.Path, writeErr)
+		return sendError(t, caps, r.Path, writeErr)
+	}
+	return t.Send(protocol.MsgRangeDone, nil)
+}
+
+// commitRanges moves the temp file assembled by receiveRange into place if
+// it hashes the same as the client's file, and answers with MsgRangeDone.
+// Otherwise the temp file is removed and the client gets MsgError.
+func commitRanges(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger, c protocol.RangeCommit) {
+	absPath, err := utils.SecureJoin(inst.Path, c.Path)
+	if err != nil {
+		log.Error("Security error: %v", err)
+		sendError(t, caps, c.Path, errInvalidPath)
+		return
+	}
+	tmpPath := utils.TempPath(absPath)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY, 0)
+	if err == nil {
+		// The temp file may be left over from an earlier, larger transfer
+		err = f.Truncate(c.Size)
+	}
+	var hash string
+	if err == nil {
+		hash, err = pkgSync.CalculateHash(tmpPath)
+	}
+	if err == nil && hash != c.Hash {
+		err = pkgSync.ErrHashMismatch
+	}
+	if err == nil {
+		err = utils.CommitFile(f, absPath, c.Mode, c.ModTime)
+	} else if f != nil {
+		f.Close()
+		os.Remove(tmpPath)
+	}
+	if err != nil {
+		log.Error("Failed to commit %s: %v", c.Path, err)
+		sendError(t, caps, c.Path, err)
+		return
+	}
+	log.Info("Received file: %s (chunked)", c.Path)
+	t.Send(protocol.MsgRangeDone, nil)
+}
+
+// sendFile answers a file request with StartFile, the content as MsgData and EndFile.
+// With resume set, the data starts after the client's partial copy if its prefix matches.
+// With CapVerify EndFile carries the hash of the whole file.
+// Only transport errors are returned, the connection can't be used afterwards.
+func sendFile(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger, relPath string, resume *protocol.PartialInfo, buf []byte) error {
+	absPath, err := utils.SecureJoin(inst.Path, relPath)
+	if err != nil {
+		log.Error("Security error: %v", err)
+		return sendError(t, caps, relPath, errInvalidPath)
+	}
+
+	f, err := os.Open(absPath)
+	if err != nil {
+		log.Error("Open file error: %v", err)
+		return sendError(t, caps, relPath, err)
 	}
+	defer f.Close()
+
+	info, _ := f.Stat()
+
+	var offset int64
+	if resume != nil && !info.IsDir() && resume.Offset > 0 && resume.Offset <= info.Size() {
+		// Reading the prefix leaves the file positioned right after it
+		if hash, err := pkgSync.CalculatePrefixHash(f, resume.Offset); err == nil && hash == resume.Hash {
+			offset = resume.Offset
+		} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Error("Seek error: %v", err)
+			return sendError(t, caps, relPath, err)
+		}
+	}
+
+	t.SendJSON(protocol.MsgStartFile, protocol.StartFileMsg{
+		Path:    relPath,
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode()),
+		ModTime: info.ModTime().Unix(),
+		Offset:  offset,
+	})
+	if offset > 0 {
+		log.Info("Sending file: %s (resuming at %d)", relPath, offset)
+	} else {
+		log.Info("Sending file: %s", relPath)
+	}
+
+	var hash []byte
+	if !info.IsDir() {
+		// Hash while the data is sent, the second read is served by the page cache
+		var hashed <-chan hashResult
+		if protocol.HasCapability(caps, protocol.CapVerify) {
+			hashed = hashInBackground(absPath)
+		}
+		t.BeginFile(relPath)
+		if err := t.SendFile(f, info.Size()-offset, buf); err != nil {
+			return err
+		}
+		if hashed != nil {
+			if r := <-hashed; r.err != nil {
+				log.Warn("Failed to hash %s, it won't be verified: %v", relPath, r.err)
+			} else {
+				hash = []byte(r.hash)
+			}
+		}
+	}
+	return t.Send(protocol.MsgEndFile, hash)
+}
+
+type hashResult struct {
+	hash string
+	err  error
+}
+
+// hashInBackground hashes the file at path while the caller goes on
+func hashInBackground(path string) <-chan hashResult {
+	hashed := make(chan hashResult, 1)
+	go func() {
+		hash, err := pkgSync.CalculateHash(path)
+		hashed <- hashResult{hash, err}
+	}()
+	return hashed
+}
+
+// hashPartial returns the hash and size of an existing partial file.
+// A partial file older than utils.PartialMaxAge is removed and reported as missing.
+func hashPartial(path string) (string, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if utils.StalePartial(info) {
+		os.Remove(path)
+		return "", 0, os.ErrNotExist
+	}
+	hash, err := pkgSync.CalculateHash(path)
+	return hash, info.Size(), err
+}
+
+// deleteFile removes relPath from the instance. Directories are deleted after
+// their contents, so only empty ones are removed, apart from leftovers of
+// interrupted transfers. A missing file counts as deleted.
+func deleteFile(inst *config.InstanceConfig, relPath string) error {
+	absPath, err := utils.SecureJoin(inst.Path, relPath)
+	if err != nil {
+		return errInvalidPath
+	}
+	if err := utils.RemovePath(absPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ackFile answers a received file with MsgFileAck, or MsgFileNack if err is
+// set, if the client verifies transfers
+func ackFile(t *protocol.Transport, caps []string, relPath string, err error) error {
+	if !protocol.HasCapability(caps, protocol.CapVerify) {
+		return nil
+	}
+	return sendResult(t, relPath, err)
+}
+
+// sendResult answers the operation on relPath with MsgFileAck, or MsgFileNack if err is set
+func sendResult(t *protocol.Transport, relPath string, err error) error {
+	if err == nil {
+		return t.Send(protocol.MsgFileAck, []byte(relPath))
+	}
+	return t.SendJSON(protocol.MsgFileNack, protocol.ErrorFor(relPath, err))
+}
+
+var (
+	errInvalidPath = protocol.NewError(protocol.ErrCodeInvalidPath, "invalid path")
+	errNotRegular  = protocol.NewError(protocol.ErrCodeNotRegular, "not a regular file")
+)
+
+// sendError answers with MsgError for err on relPath, which may be empty.
+// Clients without CapErrors get the message as plain text.
+func sendError(t *protocol.Transport, caps []string, relPath string, err error) error {
+	if !protocol.HasCapability(caps, protocol.CapErrors) {
+		return t.Send(protocol.MsgError, []byte(err.Error()))
+	}
+	return t.SendJSON(protocol.MsgError, protocol.ErrorFor(relPath, err))
+}
+
+// receiveFile stores a file pushed with StartFile. The data goes to the
+// partial file, which is verified against the hash in EndFile before it's
+// moved into place. With CapVerify the file is answered with MsgFileAck or
+// MsgFileNack. Only transport errors are returned.
+func receiveFile(t *protocol.Transport, inst *config.InstanceConfig, caps []string, log *logger.Logger, startMsg protocol.StartFileMsg) error {
+	absPath, err := utils.SecureJoin(inst.Path, startMsg.Path)
+	if err != nil {
+		log.Error("Security error: %v", err)
+		if startMsg.Delta {
+			// The client waits for a signature, an empty one makes it send literals
+			if err := sendSignature(t, &pkgSync.Signature{BlockSize: pkgSync.BlockSizeFor(0)}); err != nil {
+				return err
+			}
+		}
+		if err := t.DiscardFile(); err != nil {
+			return err
+		}
+		return ackFile(t, caps, startMsg.Path, errInvalidPath)
+	}
+
+	// Ensure dir exists
+	os.MkdirAll(filepath.Dir(absPath), 0755)
+
+	if os.FileMode(startMsg.Mode).IsDir() {
+		err := os.MkdirAll(absPath, 0755) // Ignore mode for now or use startMsg.Mode
+		if discardErr := t.DiscardFile(); discardErr != nil {
+			return discardErr
+		}
+		return ackFile(t, caps, startMsg.Path, err)
+	}
+
+	if startMsg.Delta {
+		return receiveDelta(t, absPath, startMsg, caps, log)
+	}
+
+	var f *os.File
+	if startMsg.Inplace {
+		f, err = os.OpenFile(absPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(startMsg.Mode))
+	} else {
+		// Write to the partial file, so an interrupted transfer can be resumed
+		f, err = utils.OpenPartial(utils.PartialPath(absPath), startMsg.Offset)
+	}
+	if err != nil {
+		log.Error("Create file error: %v", err)
+		if err := t.DiscardFile(); err != nil {
+			return err
+		}
+		return ackFile(t, caps, startMsg.Path, err)
+	}
+
+	hash, writeErr, err := t.ReceiveData(f, nil)
+	if err != nil {
+		// The partial file is kept, the client resumes from it
+		f.Close()
+		return err
+	}
+	if writeErr == nil {
+		writeErr = pkgSync.VerifyHash(f.Name(), string(hash))
+	}
+	if writeErr != nil {
+		log.Error("Failed to receive %s: %v", startMsg.Path, writeErr)
+		f.Close()
+		if !startMsg.Inplace {
+			// Its content can't be trusted to resume from
+			os.Remove(f.Name())
+		}
+		return ackFile(t, caps, startMsg.Path, writeErr)
+	}
+	if err := utils.CommitFile(f, absPath, startMsg.Mode, startMsg.ModTime); err != nil {
+		log.Error("Failed to move %s into place: %v", startMsg.Path, err)
+		return ackFile(t, caps, startMsg.Path, err)
+	}
+
+	if startMsg.Offset > 0 {
+		log.Info("Received file: %s (resumed at %d)", startMsg.Path, startMsg.Offset)
+	} else {
+		log.Info("Received file: %s", startMsg.Path)
+	}
+	return ackFile(t, caps, startMsg.Path, nil)
+}
+
+func sendSignature(t *protocol.Transport, sig *pkgSync.Signature) error {
+	data, err := sig.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return t.Send(protocol.MsgSignature, data)
+}
+
+// receiveDelta answers a delta StartFile with the signature of the current file,
+// then rebuilds the new content in a temp file and moves it into place once
+// it matches the hash in EndFile. Only transport errors are returned, local
+// failures skip the file and are reported with ackFile.
+func receiveDelta(t *protocol.Transport, absPath string, startMsg protocol.StartFileMsg, caps []string, log *logger.Logger) error {
+	sig := &pkgSync.Signature{BlockSize: pkgSync.BlockSizeFor(0)}
+	var basis io.ReaderAt
+	if f, err := os.Open(absPath); err == nil {
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			if s, err := pkgSync.ComputeSignature(f, pkgSync.BlockSizeFor(info.Size())); err == nil {
+				sig = s
+				basis = f
+			} else {
+				log.Warn("Failed to compute signature of %s: %v", startMsg.Path, err)
+			}
+		}
+	}
+	if err := sendSignature(t, sig); err != nil {
+		return err
+	}
+
+	tmpPath := utils.TempPath(absPath)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Error("Create file error: %v", err)
+		if err := t.DiscardFile(); err != nil {
+			return err
+		}
+		return ackFile(t, caps, startMsg.Path, err)
+	}
+
+	applier := pkgSync.NewDeltaApplier(basis, sig, f)
+	var applyErr error
+	var hash string
+	for {
+		mt, data, err := t.ReadData()
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if mt == protocol.MsgEndFile {
+			hash = string(data)
+			break
+		}
+		if mt != protocol.MsgDelta {
+			f.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("unexpected message type %v", mt)
+		}
+		if applyErr != nil {
+			continue
+		}
+		var op pkgSync.DeltaOp
+		if applyErr = op.UnmarshalBinary(data); applyErr == nil {
+			_, applyErr = applier.Apply(op)
+		}
+	}
+	if applyErr == nil {
+		applyErr = pkgSync.VerifyHash(tmpPath, hash)
+	}
+	if applyErr != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		log.Error("Failed to apply delta for %s: %v", startMsg.Path, applyErr)
+		return ackFile(t, caps, startMsg.Path, applyErr)
+	}
+	if err := utils.CommitFile(f, absPath, startMsg.Mode, startMsg.ModTime); err != nil {
+		log.Error("Failed to replace %s: %v", startMsg.Path, err)
+		return ackFile(t, caps, startMsg.Path, err)
+	}
+
+	log.Info("Received file (delta): %s", startMsg.Path)
+	return ackFile(t, caps, startMsg.Path, nil)
 }
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/taurusxin/fastsync/pkg/config"
+	"github.com/taurusxin/fastsync/pkg/logger"
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// loadTLSConfig builds the server TLS config, or returns nil if TLS is disabled
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.TLSCA != "" {
+		pool, err := utils.LoadCertPool(cfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// Log the fingerprint so clients can pin it
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		logger.Info("TLS enabled, certificate fingerprint SHA256:%s", utils.CertFingerprint(leaf))
+	}
+	if tlsCfg.ClientAuth == tls.RequireAndVerifyClientCert {
+		logger.Info("TLS client certificates required")
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,238 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression algorithms of EnableMessageCompression. The client asks for one
+// as "algo[:level]" in the handshake, and the daemon answers with the one both
+// support, falling back to zlib.
+const (
+	CompressZlib = "zlib"
+	CompressZstd = "zstd"
+	CompressLZ4  = "lz4"
+)
+
+// compressionCaps maps each algorithm to the capability announcing it
+var compressionCaps = map[string]string{
+	CompressZlib: CapCompressZlib,
+	CompressZstd: CapCompressZstd,
+	CompressLZ4:  CapCompressLZ4,
+}
+
+// maxCompressionLevel is the highest level of each algorithm
+var maxCompressionLevel = map[string]int{
+	CompressZlib: zlib.BestCompression,
+	CompressZstd: 22,
+	CompressLZ4:  9,
+}
+
+// ParseCompression parses a compression setting such as "zstd" or "zstd:3".
+// A missing level is returned as 0, the algorithm's default.
+func ParseCompression(s string) (string, int, error) {
+	algo, levelStr, hasLevel := strings.Cut(s, ":")
+	maxLevel, ok := maxCompressionLevel[algo]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown compression %q (supported: zstd, lz4, zlib)", algo)
+	}
+	if !hasLevel {
+		return algo, 0, nil
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil || level < 1 || level > maxLevel {
+		return "", 0, fmt.Errorf("invalid %s compression level %q (1 to %d)", algo, levelStr, maxLevel)
+	}
+	return algo, level, nil
+}
+
+// ChooseCompression returns the algorithm to use when algo was asked for and
+// both sides support caps. Without support for algo it falls back to zlib,
+// and returns "" if that is missing too.
+func ChooseCompression(algo string, caps []string) string {
+	if c, ok := compressionCaps[algo]; ok && HasCapability(caps, c) {
+		return algo
+	}
+	if HasCapability(caps, CapCompressZlib) {
+		return CompressZlib
+	}
+	return ""
+}
+
+// With CapCompressMsgs the connection itself isn't compressed. Instead
+// each message payload is compressed on its own and flagged in the message
+// type, so the data of a file can be sent uncompressed when compressing it
+// would only burn CPU. See Transport.BeginFile.
+const (
+	// compressedFlag marks a message type whose payload is compressed
+	compressedFlag MessageType = 0x80
+	// minCompressSize is the smallest payload worth compressing
+	minCompressSize = 512
+	// maxCompressRatio is the compressed size relative to the original
+	// above which a payload is sent uncompressed
+	maxCompressRatio = 0.9
+)
+
+// DefaultSkipCompress lists the extensions of files whose content is
+// compressed already, so their data is never compressed again
+var DefaultSkipCompress = []string{
+	"7z", "aac", "apk", "avi", "avif", "br", "bz2", "deb", "dmg", "docx", "flac",
+	"gif", "gz", "heic", "jar", "jpeg", "jpg", "lz4", "m4a", "m4v", "mkv", "mov",
+	"mp3", "mp4", "ogg", "opus", "png", "pptx", "rar", "rpm", "tgz", "webm",
+	"webp", "xlsx", "xz", "zip", "zst",
+}
+
+// ParseExtensions parses a comma separated list of file extensions,
+// with or without the leading dot
+func ParseExtensions(s string) []string {
+	var exts []string
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// MessageCompression configures the per message compression of a Transport
+type MessageCompression struct {
+	Algo  string
+	Level int
+	// Skip are extensions whose data is not compressed, in addition to
+	// DefaultSkipCompress
+	Skip []string
+}
+
+// skips reports whether the data of the file at name is never compressed
+func (c *MessageCompression) skips(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	return ext != "" && (slices.Contains(DefaultSkipCompress, ext) || slices.Contains(c.Skip, ext))
+}
+
+// messageCodec compresses and decompresses single payloads. The compressed
+// form starts with the original length as uvarint. Compression and
+// decompression may run concurrently, they share no state.
+type messageCodec struct {
+	algo  string
+	level int
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+
+	zw   *zlib.Writer
+	zbuf bytes.Buffer
+	zr   io.ReadCloser
+}
+
+func newMessageCodec(algo string, level int) (*messageCodec, error) {
+	c := &messageCodec{algo: algo, level: level}
+	var err error
+	switch algo {
+	case CompressZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		if c.zenc, err = zstd.NewWriter(nil, opts...); err == nil {
+			c.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxMessageSize))
+		}
+	case CompressZlib:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		c.zw, err = zlib.NewWriterLevel(&c.zbuf, level)
+	case CompressLZ4:
+	default:
+		err = fmt.Errorf("unknown compression %q", algo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// compress returns the compressed form of src, or nil if it isn't smaller
+func (c *messageCodec) compress(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)), uint64(len(src)))
+	switch c.algo {
+	case CompressZstd:
+		dst = c.zenc.EncodeAll(src, dst)
+	case CompressZlib:
+		c.zbuf.Reset()
+		c.zw.Reset(&c.zbuf)
+		if _, err := c.zw.Write(src); err != nil {
+			return nil
+		}
+		if err := c.zw.Close(); err != nil {
+			return nil
+		}
+		dst = append(dst, c.zbuf.Bytes()...)
+	case CompressLZ4:
+		block := make([]byte, lz4.CompressBlockBound(len(src)))
+		var n int
+		var err error
+		if c.level > 0 {
+			n, err = lz4.CompressBlockHC(src, block, lz4.CompressionLevel(1<<(8+c.level)), nil, nil)
+		} else {
+			n, err = lz4.CompressBlock(src, block, nil)
+		}
+		if err != nil || n == 0 {
+			return nil
+		}
+		dst = append(dst, block[:n]...)
+	}
+	if float64(len(dst)) > float64(len(src))*maxCompressRatio {
+		return nil
+	}
+	return dst
+}
+
+// decompress returns the original of a payload made by compress
+func (c *messageCodec) decompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > MaxMessageSize {
+		return nil, fmt.Errorf("invalid compressed message")
+	}
+	src = src[n:]
+	dst := make([]byte, size)
+	var err error
+	switch c.algo {
+	case CompressZstd:
+		var out []byte
+		out, err = c.zdec.DecodeAll(src, dst[:0])
+		if err == nil && len(out) != len(dst) {
+			err = fmt.Errorf("compressed message has %d bytes instead of %d", len(out), len(dst))
+		}
+		dst = out
+	case CompressZlib:
+		if c.zr == nil {
+			c.zr, err = zlib.NewReader(bytes.NewReader(src))
+		} else {
+			err = c.zr.(zlib.Resetter).Reset(bytes.NewReader(src), nil)
+		}
+		if err == nil {
+			_, err = io.ReadFull(c.zr, dst)
+		}
+	case CompressLZ4:
+		var m int
+		m, err = lz4.UncompressBlock(src, dst)
+		if err == nil && m != len(dst) {
+			err = fmt.Errorf("compressed message has %d bytes instead of %d", m, len(dst))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing message: %w", err)
+	}
+	return dst, nil
+}
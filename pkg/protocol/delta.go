@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A MsgDeltaReq carries the path and the signature of the basis file in one
+// message, so nothing else sent on the transport can come between them:
+//
+//	path      uvarint length, followed by the path
+//	signature the rest, see sync.Signature.MarshalBinary
+
+var errShortDeltaReq = errors.New("truncated delta request")
+
+// EncodeDeltaReq encodes a delta request for path with an encoded signature
+func EncodeDeltaReq(path string, sig []byte) []byte {
+	data := make([]byte, 0, binary.MaxVarintLen64+len(path)+len(sig))
+	data = binary.AppendUvarint(data, uint64(len(path)))
+	data = append(data, path...)
+	return append(data, sig...)
+}
+
+// DecodeDeltaReq splits a delta request into the path and the encoded signature
+func DecodeDeltaReq(data []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return "", nil, errShortDeltaReq
+	}
+	data = data[size:]
+	return string(data[:n]), data[n:], nil
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeltaReqRoundTrip(t *testing.T) {
+	tests := []struct {
+		path string
+		sig  []byte
+	}{
+		{"a.txt", []byte{0, 0, 2, 188, 1, 2, 3}},
+		{"sub/ünïcödé.bin", nil},
+		{"", []byte{1}},
+		{string(bytes.Repeat([]byte("d/"), 200)) + "f", bytes.Repeat([]byte{7}, 1000)},
+	}
+	for _, tt := range tests {
+		path, sig, err := DecodeDeltaReq(EncodeDeltaReq(tt.path, tt.sig))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.path, err)
+		}
+		if path != tt.path || !bytes.Equal(sig, tt.sig) {
+			t.Fatalf("decoded %q with %d signature bytes, want %q with %d", path, len(sig), tt.path, len(tt.sig))
+		}
+	}
+}
+
+func TestDecodeDeltaReqMalformed(t *testing.T) {
+	for _, data := range [][]byte{nil, {0x80}, {4, 'a', 'b', 'c'}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		if path, _, err := DecodeDeltaReq(data); err == nil {
+			t.Errorf("decoded %v as %q", data, path)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Codes of ErrorMsg
+const (
+	ErrCodeUnknown        = "unknown"           // Sent by peers without CapErrors
+	ErrCodeIO             = "io_error"          // Reading or writing a file failed
+	ErrCodeNotFound       = "not_found"         // The file doesn't exist
+	ErrCodePermission     = "permission_denied" // The file may not be accessed
+	ErrCodeInvalidPath    = "invalid_path"      // The path lies outside of the instance
+	ErrCodeNotRegular     = "not_regular_file"  // A file was expected, but it is a directory or special file
+	ErrCodeInvalidRequest = "invalid_request"   // The request can't be served as sent
+	ErrCodeHashMismatch   = "hash_mismatch"     // The file doesn't hash to what its sender read
+)
+
+// ErrorMsg is the payload of MsgError and MsgFileNack with CapErrors.
+// Peers without it send MsgError as plain text, see DecodeError.
+type ErrorMsg struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Path is the file the error is about, relative to the instance
+	Path string `json:"path,omitempty"`
+	// Retryable is set if the same operation may succeed when tried again
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// NewError returns an error with code
+func NewError(code, message string) *ErrorMsg {
+	return &ErrorMsg{Code: code, Message: message}
+}
+
+func (e *ErrorMsg) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an ErrorMsg with the same code, so an error
+// decoded from the peer matches the sentinel error it was made from
+func (e *ErrorMsg) Is(target error) bool {
+	t, ok := target.(*ErrorMsg)
+	return ok && t.Code == e.Code
+}
+
+// ErrorFor returns the ErrorMsg to report err on path. An ErrorMsg in err
+// keeps its code, file system errors get theirs and anything else is an I/O
+// error. The local path of file system errors isn't revealed.
+func ErrorFor(path string, err error) *ErrorMsg {
+	var e *ErrorMsg
+	if errors.As(err, &e) {
+		msg := *e
+		if msg.Path == "" {
+			msg.Path = path
+		}
+		return &msg
+	}
+
+	msg := &ErrorMsg{Code: ErrCodeIO, Message: err.Error(), Path: path}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		msg.Code = ErrCodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		msg.Code = ErrCodePermission
+	}
+	var pe *fs.PathError
+	if path != "" && errors.As(err, &pe) {
+		msg.Message = fmt.Sprintf("%s: %v", pe.Op, pe.Err)
+	}
+	return msg
+}
+
+// DecodeError decodes the payload of MsgError or MsgFileNack. Plain text
+// from peers without CapErrors becomes an ErrorMsg with ErrCodeUnknown.
+func DecodeError(data []byte) *ErrorMsg {
+	var e ErrorMsg
+	if err := json.Unmarshal(data, &e); err != nil || e.Message == "" {
+		return &ErrorMsg{Code: ErrCodeUnknown, Message: string(data)}
+	}
+	if e.Code == "" {
+		e.Code = ErrCodeUnknown
+	}
+	return &e
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Binary file list encoding, used for MsgFileList batches when both sides
+// have CapFileListBinary. Each entry is:
+//
+//	flags   byte     fileIsDir, fileHasHash
+//	prefix  uvarint  bytes shared with the previous path in the batch
+//	suffix  uvarint  length, followed by the rest of the path
+//	size    uvarint
+//	modTime varint
+//	mode    uvarint
+//	hash    16 bytes MD5, only with fileHasHash
+const (
+	fileIsDir = 1 << iota
+	fileHasHash
+)
+
+const hashSize = 16
+
+var (
+	errShortFileList    = errors.New("truncated file list entry")
+	errFileListOverflow = errors.New("file list entry out of range")
+)
+
+// EncodeFileList encodes a batch of file list entries
+func EncodeFileList(files []FileInfo) ([]byte, error) {
+	var buf []byte
+	prev := ""
+	for _, f := range files {
+		var flags byte
+		if f.IsDir {
+			flags |= fileIsDir
+		}
+		var hash []byte
+		if f.Hash != "" {
+			var err error
+			hash, err = hex.DecodeString(f.Hash)
+			if err != nil || len(hash) != hashSize {
+				return nil, fmt.Errorf("invalid hash for %s", f.Path)
+			}
+			flags |= fileHasHash
+		}
+
+		n := 0
+		for n < len(prev) && n < len(f.Path) && prev[n] == f.Path[n] {
+			n++
+		}
+
+		buf = append(buf, flags)
+		buf = binary.AppendUvarint(buf, uint64(n))
+		buf = binary.AppendUvarint(buf, uint64(len(f.Path)-n))
+		buf = append(buf, f.Path[n:]...)
+		buf = binary.AppendUvarint(buf, uint64(f.Size))
+		buf = binary.AppendVarint(buf, f.ModTime)
+		buf = binary.AppendUvarint(buf, uint64(f.Mode))
+		buf = append(buf, hash...)
+		prev = f.Path
+	}
+	return buf, nil
+}
+
+// DecodeFileList decodes a batch encoded by EncodeFileList
+func DecodeFileList(data []byte) ([]FileInfo, error) {
+	var files []FileInfo
+	prev := ""
+	for len(data) > 0 {
+		flags := data[0]
+		data = data[1:]
+
+		prefix, err := readUvarint(&data)
+		if err != nil {
+			return nil, err
+		}
+		suffix, err := readUvarint(&data)
+		if err != nil {
+			return nil, err
+		}
+		if prefix > uint64(len(prev)) || suffix > uint64(len(data)) {
+			return nil, errShortFileList
+		}
+		f := FileInfo{
+			Path:  prev[:prefix] + string(data[:suffix]),
+			IsDir: flags&fileIsDir != 0,
+		}
+		data = data[suffix:]
+
+		size, err := readUvarint(&data)
+		if err != nil {
+			return nil, err
+		}
+		if size > math.MaxInt64 {
+			return nil, errFileListOverflow
+		}
+		f.Size = int64(size)
+		modTime, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, errShortFileList
+		}
+		f.ModTime = modTime
+		data = data[n:]
+		mode, err := readUvarint(&data)
+		if err != nil {
+			return nil, err
+		}
+		if mode > math.MaxUint32 {
+			return nil, errFileListOverflow
+		}
+		f.Mode = uint32(mode)
+
+		if flags&fileHasHash != 0 {
+			if len(data) < hashSize {
+				return nil, errShortFileList
+			}
+			f.Hash = hex.EncodeToString(data[:hashSize])
+			data = data[hashSize:]
+		}
+
+		files = append(files, f)
+		prev = f.Path
+	}
+	return files, nil
+}
+
+func readUvarint(data *[]byte) (uint64, error) {
+	v, n := binary.Uvarint(*data)
+	if n <= 0 {
+		return 0, errShortFileList
+	}
+	*data = (*data)[n:]
+	return v, nil
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestFileListRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []FileInfo
+	}{
+		{"empty", nil},
+		{"single file", []FileInfo{
+			{Path: "a.txt", Size: 6, ModTime: 1700000000, Mode: 0644},
+		}},
+		{"directory", []FileInfo{
+			{Path: "sub", ModTime: 1700000000, Mode: 0755 | 1<<31, IsDir: true},
+		}},
+		{"shared prefixes", []FileInfo{
+			{Path: "sub/deep/f1.txt", Size: 7, ModTime: 1, Mode: 0644},
+			{Path: "sub/deep/f10.txt", Size: 8, ModTime: 2, Mode: 0644},
+			{Path: "sub/deep2", Mode: 0755, IsDir: true},
+			{Path: "sub", Mode: 0755, IsDir: true},
+			{Path: "other", Size: 1, Mode: 0600},
+		}},
+		{"hashes", []FileInfo{
+			{Path: "a", Size: 1, Mode: 0644, Hash: "0cc175b9c0f1b6a831c399e269772661"},
+			{Path: "b", Size: 0, Mode: 0644},
+			{Path: "c", Size: 1, Mode: 0644, Hash: "4a8a08f09d37b73795649038408b5f33"},
+		}},
+		{"extremes", []FileInfo{
+			{Path: "big", Size: 1<<63 - 1, ModTime: -1, Mode: 1<<32 - 1},
+			{Path: "old", ModTime: -1 << 63},
+			{Path: "ünïcödé/文件.txt", Size: 3, ModTime: 1<<63 - 1},
+		}},
+		{"empty path", []FileInfo{{Path: "", Mode: 0755, IsDir: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := EncodeFileList(tt.files)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			got, err := DecodeFileList(data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.files) {
+				t.Fatalf("decoded %+v, want %+v", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestEncodeFileListInvalidHash(t *testing.T) {
+	for _, hash := range []string{"xyz", "0cc175b9", "0cc175b9c0f1b6a831c399e26977266100"} {
+		if _, err := EncodeFileList([]FileInfo{{Path: "a", Hash: hash}}); err == nil {
+			t.Errorf("hash %q was encoded", hash)
+		}
+	}
+}
+
+// entry encodes a raw file list entry, without checking its fields
+func entry(flags byte, prefix, suffix uint64, path string, size uint64, modTime int64, mode uint64) []byte {
+	b := []byte{flags}
+	b = binary.AppendUvarint(b, prefix)
+	b = binary.AppendUvarint(b, suffix)
+	b = append(b, path...)
+	b = binary.AppendUvarint(b, size)
+	b = binary.AppendVarint(b, modTime)
+	return binary.AppendUvarint(b, mode)
+}
+
+func TestDecodeFileListMalformed(t *testing.T) {
+	valid := entry(0, 0, 3, "abc", 1, 1, 0644)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"flags only", []byte{0}},
+		{"truncated varint", []byte{0, 0x80}},
+		{"suffix beyond data", entry(0, 0, 10, "abc", 1, 1, 0644)},
+		{"prefix without previous path", entry(0, 1, 3, "abc", 1, 1, 0644)},
+		{"prefix beyond previous path", append(valid, entry(0, 4, 1, "d", 1, 1, 0644)...)},
+		{"missing size", []byte{0, 0, 1, 'a'}},
+		{"missing mod time", []byte{0, 0, 1, 'a', 1}},
+		{"missing mode", []byte{0, 0, 1, 'a', 1, 2}},
+		{"missing hash", entry(fileHasHash, 0, 1, "a", 1, 1, 0644)},
+		{"short hash", append(entry(fileHasHash, 0, 1, "a", 1, 1, 0644), make([]byte, hashSize-1)...)},
+		{"size overflow", entry(0, 0, 1, "a", 1<<63, 1, 0644)},
+		{"mode overflow", entry(0, 0, 1, "a", 1, 1, 1<<32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if files, err := DecodeFileList(tt.data); err == nil {
+				t.Fatalf("decoded %+v", files)
+			}
+		})
+	}
+}
+
+func TestDecodeFileListTruncated(t *testing.T) {
+	data, err := EncodeFileList([]FileInfo{
+		{Path: "dir/file", Size: 123456, ModTime: 1700000000, Mode: 0644, Hash: "0cc175b9c0f1b6a831c399e269772661"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every cut inside the entry must be detected
+	for n := 1; n < len(data); n++ {
+		if files, err := DecodeFileList(data[:n]); err == nil {
+			t.Errorf("decoded %d of %d bytes: %+v", n, len(data), files)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"io"
+	"time"
+)
+
+// A connection with an idle timeout is dropped when nothing arrived for that
+// long. The deadlines slide with every message, so long transfers are fine
+// as long as data flows. With CapHeartbeat each side announces its idle
+// timeout in the handshake and the other sends MsgPing whenever it sent
+// nothing for a third of it, so a peer that is busy scanning or hashing
+// isn't mistaken for a dead one. MsgPing is answered with MsgPong. Both are
+// handled by the Transport, its callers never see them.
+
+// heartbeatsPerTimeout is how many heartbeats are sent within the peer's idle timeout
+const heartbeatsPerTimeout = 3
+
+// deadliner is a connection whose reads and writes can time out
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// SetIdleTimeout makes reads fail when nothing arrived for d and writes when
+// they made no progress for d, 0 for never. It only applies to network
+// connections and must be called before the transport is used concurrently.
+func (t *Transport) SetIdleTimeout(d time.Duration) {
+	t.idle = d
+}
+
+// extendRead moves the read deadline to the idle timeout from now
+func (t *Transport) extendRead() {
+	if t.idle > 0 && t.dl != nil {
+		t.dl.SetReadDeadline(time.Now().Add(t.idle))
+	}
+}
+
+// extendWrite moves the write deadline to the idle timeout from now
+func (t *Transport) extendWrite() {
+	if t.idle > 0 && t.dl != nil {
+		t.dl.SetWriteDeadline(time.Now().Add(t.idle))
+	}
+}
+
+// StartHeartbeat sends MsgPing whenever nothing was sent for a third of
+// peerTimeout, 0 if the peer has none, and answers the peer's pings. It must
+// be called after compression is enabled and before the transport is used
+// concurrently. The heartbeat stops when the transport is closed or fails.
+func (t *Transport) StartHeartbeat(peerTimeout time.Duration) {
+	t.pong = make(chan struct{}, 1)
+	t.done = make(chan struct{})
+	interval := peerTimeout / heartbeatsPerTimeout
+
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			var err error
+			select {
+			case <-t.done:
+				return
+			case <-t.pong:
+				err = t.Send(MsgPong, nil)
+			case <-tick:
+				// Anything sent in the last half interval will do, so the
+				// peer hears from us at least every one and a half intervals
+				t.wmu.Lock()
+				quiet := time.Since(t.lastSend) >= interval/2
+				t.wmu.Unlock()
+				if quiet {
+					err = t.Send(MsgPing, nil)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// handleHeartbeat consumes a MsgPing or MsgPong of length bytes and queues
+// the answer to a ping. It reports whether the message was one of them.
+func (t *Transport) handleHeartbeat(msgType MessageType, length uint32) (bool, error) {
+	if msgType != MsgPing && msgType != MsgPong {
+		return false, nil
+	}
+	if _, err := io.CopyN(io.Discard, t.GetConn(), int64(length)); err != nil {
+		return true, err
+	}
+	if msgType == MsgPing {
+		// A pong is still pending otherwise, one answers both
+		select {
+		case t.pong <- struct{}{}:
+		default:
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,424 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// With CapMux the authenticated connection carries several independent
+// streams. A stream is a byte stream that gets wrapped in its own Transport,
+// so the usual messages run unchanged on each of them. Frames on the connection:
+//
+//	MsgStreamData   id u32, data. Empty data opens the stream
+//	MsgStreamWindow id u32, increment u32. The receiver consumed that many bytes
+//	MsgStreamClose  id u32. The sender won't write to the stream anymore
+//	MsgStreamReset  id u32. The sender abandoned the stream, it neither reads
+//	                nor writes anymore. Pending reads and writes of the peer fail
+//
+// Stream 0 exists from the start and carries the control messages of the
+// session, further streams are opened by the client. At most StreamWindow
+// bytes may be unconsumed per stream, so the connection reader never blocks
+// on a slow stream and a large transfer can't starve the others.
+const (
+	StreamWindow = 1024 * 1024
+	// streamFrameSize is the most data sent in one frame, so frames of
+	// concurrent streams interleave finely
+	streamFrameSize = 32 * 1024
+	// MaxStreams limits the streams open at once on a connection
+	MaxStreams = 64
+	// shutdownTimeout is how long Shutdown waits for the peer to close the connection
+	shutdownTimeout = 30 * time.Second
+)
+
+var (
+	errMuxClosed   = errors.New("connection closed")
+	errStreamReset = errors.New("stream reset")
+)
+
+// Mux multiplexes streams over a Transport
+type Mux struct {
+	t   *Transport
+	wmu sync.Mutex // Serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	lastID  uint32 // Highest stream id opened so far
+	client  bool
+	err     error // Why the connection ended
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// NewMux starts multiplexing on t. Only the client side may open streams.
+func NewMux(t *Transport, client bool) *Mux {
+	m := &Mux{
+		t:       t,
+		streams: make(map[uint32]*Stream),
+		client:  client,
+		accept:  make(chan *Stream, MaxStreams),
+		done:    make(chan struct{}),
+	}
+	m.streams[0] = newStream(m, 0)
+	go m.readLoop()
+	return m
+}
+
+// Control returns stream 0
+func (m *Mux) Control() *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[0]
+}
+
+// Open opens a new stream
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= MaxStreams {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("too many streams")
+	}
+	m.lastID++
+	s := newStream(m, m.lastID)
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(MsgStreamData, s.id, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// Done is closed when the connection has ended
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Shutdown closes all streams and waits for the peer to close the
+// connection, so everything written so far is processed before it returns.
+// It closes the connection itself if the peer doesn't within shutdownTimeout.
+func (m *Mux) Shutdown() error {
+	m.mu.Lock()
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, s := range m.streams {
+		streams = append(streams, s)
+	}
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.Close()
+	}
+	select {
+	case <-m.done:
+	case <-time.After(shutdownTimeout):
+	}
+	return m.Close()
+}
+
+// Close closes the connection, pending stream reads and writes fail
+func (m *Mux) Close() error {
+	return m.t.Close()
+}
+
+func (m *Mux) writeFrame(msgType MessageType, id uint32, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, id)
+	copy(frame[4:], data)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.t.Send(msgType, frame)
+}
+
+// writeFileFrame sends a data frame of the next n bytes of f with sendfile.
+// A file that ends early leaves the frame short, so the connection is closed.
+func (m *Mux) writeFileFrame(id uint32, f *os.File, n int64) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], id)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.t.wmu.Lock()
+	err := m.t.sendFileMsg(MsgStreamData, prefix[:], f, n)
+	m.t.wmu.Unlock()
+	if err != nil {
+		m.t.Close()
+	}
+	return err
+}
+
+func (m *Mux) readLoop() {
+	var err error
+	for err == nil {
+		var msgType MessageType
+		var data []byte
+		msgType, data, err = m.t.ReadData()
+		if err == nil {
+			err = m.dispatch(msgType, data)
+		}
+	}
+	m.fail(err)
+}
+
+func (m *Mux) dispatch(msgType MessageType, data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("short stream frame")
+	}
+	id := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	m.mu.Lock()
+	s := m.streams[id]
+	if s == nil && msgType == MsgStreamData && !m.client && id > m.lastID {
+		// The peer opens a new stream
+		if len(m.streams) >= MaxStreams {
+			m.mu.Unlock()
+			return fmt.Errorf("too many streams")
+		}
+		m.lastID = id
+		s = newStream(m, id)
+		m.streams[id] = s
+		m.accept <- s
+	}
+	m.mu.Unlock()
+	if s == nil {
+		// Late frame for a stream that is gone
+		return nil
+	}
+
+	switch msgType {
+	case MsgStreamData:
+		return s.push(data)
+	case MsgStreamWindow:
+		if len(data) < 4 {
+			return fmt.Errorf("short window frame")
+		}
+		s.grant(int(binary.BigEndian.Uint32(data)))
+	case MsgStreamClose:
+		s.closeRead()
+	case MsgStreamReset:
+		m.remove(id)
+		s.fail(errStreamReset)
+	default:
+		return fmt.Errorf("unexpected message type on multiplexed connection: %v", msgType)
+	}
+	return nil
+}
+
+// fail ends all streams after the connection has ended
+func (m *Mux) fail(err error) {
+	if err == io.EOF {
+		err = errMuxClosed
+	}
+	m.mu.Lock()
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*Stream{}
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.fail(err)
+	}
+	close(m.done)
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Stream is one stream of a Mux
+type Stream struct {
+	m  *Mux
+	id uint32
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte // Received but not yet read
+	consumed int    // Read but not yet granted back to the peer
+	credit   int    // Bytes we may still send
+	rclosed  bool   // The peer closed its side
+	wclosed  bool   // We closed our side
+	err      error
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	s := &Stream{m: m, id: id, credit: StreamWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 && !s.rclosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		defer s.mu.Unlock()
+		if s.rclosed {
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.consumed += n
+	grant := 0
+	if s.consumed >= StreamWindow/4 {
+		grant, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		var inc [4]byte
+		binary.BigEndian.PutUint32(inc[:], uint32(grant))
+		if err := s.m.writeFrame(MsgStreamWindow, s.id, inc[:]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// reserve waits for credit and takes up to n bytes of it, at most a frame
+func (s *Stream) reserve(n int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.credit == 0 && !s.wclosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.wclosed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	c := int(min(n, int64(s.credit), streamFrameSize))
+	s.credit -= c
+	return c, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := s.reserve(int64(len(p)))
+		if err != nil {
+			return written, err
+		}
+		if err := s.m.writeFrame(MsgStreamData, s.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// sendFile writes the next n bytes of f to the stream. The data goes from
+// the file to the connection with sendfile, see zeroCopy.
+func (s *Stream) sendFile(f *os.File, n int64) (int64, error) {
+	var written int64
+	for written < n {
+		c, err := s.reserve(n - written)
+		if err != nil {
+			return written, err
+		}
+		if err := s.m.writeFileFrame(s.id, f, int64(c)); err != nil {
+			return written, err
+		}
+		written += int64(c)
+	}
+	return written, nil
+}
+
+// Close ends our side of the stream. Reading continues until the peer closes its side.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.wclosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.wclosed = true
+	gone := s.rclosed
+	failed := s.err != nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if gone {
+		s.m.remove(s.id)
+	}
+	if failed {
+		return nil
+	}
+	return s.m.writeFrame(MsgStreamClose, s.id, nil)
+}
+
+// Reset abandons the stream. Data the peer still sends is dropped and its
+// pending reads and writes fail.
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	failed := s.err != nil
+	s.mu.Unlock()
+	s.m.remove(s.id)
+	s.fail(errStreamReset)
+	if failed {
+		return nil
+	}
+	return s.m.writeFrame(MsgStreamReset, s.id, nil)
+}
+
+func (s *Stream) push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf)+len(data) > StreamWindow {
+		return fmt.Errorf("stream %d exceeded its window", s.id)
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) closeRead() {
+	s.mu.Lock()
+	s.rclosed = true
+	gone := s.wclosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if gone {
+		s.m.remove(s.id)
+	}
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair returns the client and daemon side of a multiplexed connection
+func muxPair(t *testing.T) (*Mux, *Mux) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client := NewMux(NewTransport(c1), true)
+	daemon := NewMux(NewTransport(c2), false)
+	t.Cleanup(func() {
+		client.Close()
+		daemon.Close()
+	})
+	return client, daemon
+}
+
+// within fails the test if fn doesn't return within a few seconds
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked", what)
+	}
+}
+
+func TestMuxStreamRoundTrip(t *testing.T) {
+	client, daemon := muxPair(t)
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Larger than the window, so it only gets through with credit granted back
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*StreamWindow/16+7)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Write(data)
+		if err == nil {
+			err = s.Close()
+		}
+		errc <- err
+	}()
+
+	var got []byte
+	within(t, "transfer", func() {
+		d, err := daemon.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got, err = io.ReadAll(d)
+		if err != nil {
+			t.Error(err)
+		}
+		d.Close()
+	})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestMuxWriteBlocksWithoutCredit(t *testing.T) {
+	client, daemon := muxPair(t)
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := daemon.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan int, 1)
+	go func() {
+		n, _ := d.Write(make([]byte, StreamWindow+1))
+		written <- n
+	}()
+	select {
+	case n := <-written:
+		t.Fatalf("write of %d bytes past the window returned", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reading frees the window
+	within(t, "read", func() {
+		io.ReadFull(s, make([]byte, StreamWindow+1))
+	})
+	if n := <-written; n != StreamWindow+1 {
+		t.Fatalf("wrote %d bytes, want %d", n, StreamWindow+1)
+	}
+}
+
+func TestMuxCloseIsHalfClose(t *testing.T) {
+	client, daemon := muxPair(t)
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := daemon.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after close: %v, want %v", err, io.ErrClosedPipe)
+	}
+	within(t, "read of closed stream", func() {
+		if _, err := d.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read: %v, want EOF", err)
+		}
+	})
+
+	// The other direction stays open
+	go d.Write([]byte("answer"))
+	within(t, "read of open direction", func() {
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "answer" {
+			t.Errorf("read %q, %v", buf, err)
+		}
+	})
+}
+
+func TestMuxResetWakesWriter(t *testing.T) {
+	client, daemon := muxPair(t)
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := daemon.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := d.Write(make([]byte, 2*StreamWindow))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, "write to reset stream", func() {
+		if err := <-errc; !errors.Is(err, errStreamReset) {
+			t.Errorf("write: %v, want %v", err, errStreamReset)
+		}
+	})
+	if _, err := d.Read(make([]byte, 1)); !errors.Is(err, errStreamReset) {
+		t.Fatalf("read: %v, want %v", err, errStreamReset)
+	}
+
+	// The connection carries on
+	s2, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s2.Write([]byte("ok"))
+	within(t, "new stream", func() {
+		d2, err := daemon.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(d2, buf); err != nil || string(buf) != "ok" {
+			t.Errorf("read %q, %v", buf, err)
+		}
+	})
+}
+
+func TestMuxConnectionEndFailsStreams(t *testing.T) {
+	client, daemon := muxPair(t)
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := daemon.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := d.Write(make([]byte, 2*StreamWindow))
+		errc <- err
+	}()
+	client.Close()
+	within(t, "write on closed connection", func() {
+		if err := <-errc; err == nil {
+			t.Error("write succeeded")
+		}
+	})
+	within(t, "read on closed connection", func() {
+		if _, err := s.Read(make([]byte, 1)); err == nil {
+			t.Error("read succeeded")
+		}
+	})
+	if _, err := client.Open(); err == nil {
+		t.Fatal("opened a stream on a closed connection")
+	}
+}
+
+func TestMuxRejectsExceededWindow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	raw := NewTransport(c1)
+	daemon := NewMux(NewTransport(c2), false)
+	defer daemon.Close()
+	defer raw.Close()
+
+	// A peer that ignores flow control ends the connection
+	go func() {
+		frame := make([]byte, 4+streamFrameSize)
+		frame[3] = 1
+		for range StreamWindow/streamFrameSize + 1 {
+			if raw.Send(MsgStreamData, frame) != nil {
+				return
+			}
+		}
+	}()
+	within(t, "connection end", func() { <-daemon.Done() })
+}
@@ -1,42 +1,101 @@
 package protocol
 
 import (
-	"compress/zlib"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 type MessageType byte
 
 const (
-	MsgAuthReq  MessageType = iota // {Instance, Password, Mode (Send/Receive)}
+	MsgAuthReq  MessageType = iota // {Version, Capabilities, Instance, Mode (Send/Receive)}
 	MsgAuthResp                    // {Success, Message}
-	MsgFileList                    // []FileInfo
+	MsgFileList                    // []FileInfo, one batch of the file list
 	MsgFileReq                     // Path
 	MsgFileData                    // {Path, Data} (Chunk) - Wait, sending Path every chunk is wasteful.
 	// Better: StartFile(Path, Size, Mode), Data(Chunk), EndFile
 	MsgStartFile
 	MsgData
-	MsgEndFile
-	MsgDeleteFile // Path
-	MsgError
-	MsgDone // Sync complete
+	MsgEndFile       // With CapVerify the MD5 of the whole file as hex, empty for directories
+	MsgDeleteFile    // Path
+	MsgError         // ErrorMsg with CapErrors, plain text otherwise
+	MsgDone          // Sync complete
+	MsgSignature     // Block signatures of the receiver's basis file (binary)
+	MsgDelta         // Delta instruction, copy basis blocks or literal data (binary)
+	MsgDeltaReq      // Path and signature, see EncodeDeltaReq. Like MsgFileReq but answered with delta
+	MsgPartialReq    // Path. Asks the receiver for its partial copy of a file
+	MsgPartialInfo   // PartialInfo, answer to MsgPartialReq
+	MsgResumeReq     // PartialInfo. Like MsgFileReq but continues after the given prefix
+	MsgAuthChallenge // AuthChallenge, answer to MsgAuthReq if the instance has a password
+	MsgAuthProof     // AuthProof, answer to MsgAuthChallenge
+	MsgFileListEnd   // Ends a file list sent as several MsgFileList batches
+	MsgStreamData    // Multiplexed stream data, see Mux
+	MsgStreamWindow  // Multiplexed stream flow control credit
+	MsgStreamClose   // Multiplexed stream end
+	MsgStreamReset   // Multiplexed stream abort
+	MsgRangeReq      // RangeMsg. Asks for a byte range of a file, answered with MsgData and MsgEndFile
+	MsgRangeStart    // RangeMsg, followed by MsgData and MsgEndFile. Writes a range into the receiver's temp file
+	MsgRangeDone     // Acknowledges MsgRangeStart or MsgRangeCommit
+	MsgRangeCommit   // RangeCommit. Moves the temp file written by ranges into place
+	MsgHashReq       // Path. Asks for the hash of a whole file
+	MsgHashInfo      // FileHash, answer to MsgHashReq
+	MsgFileAck       // Path. With CapVerify the receiver verified and stored a file
+	MsgFileNack      // ErrorMsg. With CapVerify the receiver rejected a file
+	MsgPing          // Heartbeat with CapHeartbeat, answered with MsgPong
+	MsgPong          // Answer to MsgPing
 )
 
 const (
 	// MaxMessageSize limits the maximum size of a single message payload (10MB).
 	// This prevents OOM attacks where a malicious client sends a huge length header.
 	MaxMessageSize = 10 * 1024 * 1024
+
+	// FileListBatchSize is the number of entries per MsgFileList batch
+	FileListBatchSize = 1000
+
+	// DataFrameSize is the payload of the MsgData messages SendFile sends
+	// with sendfile. Larger frames mean fewer system calls per byte.
+	DataFrameSize = 4 * 1024 * 1024
+
+	// compressedDataSize is the payload of the MsgData messages SendFile
+	// compresses. Each is compressed on its own, so larger ones give the
+	// compressor a useful window.
+	compressedDataSize = 256 * 1024
 )
 
 type AuthRequest struct {
-	Instance string
-	Password string
-	IsSender bool // If true, Client wants to SEND files to Server (Server is Receiver).
+	Version      int      // Protocol version of the client, see ProtocolVersion
+	Capabilities []string // Features supported by the client
+	Instance     string
+	IsSender     bool // If true, Client wants to SEND files to Server (Server is Receiver).
 	// If false, Client wants to RECEIVE files from Server (Server is Sender).
-	Compress bool
+	// Compression is the requested algorithm and level, "zstd:3" for example
+	Compression string
+	// SkipCompress are extensions whose data the daemon sends uncompressed
+	// with per message compression, in addition to its own list
+	SkipCompress []string
+	// IdleTimeout is how many seconds the client waits for data before it
+	// drops the connection, 0 for no limit. See StartHeartbeat.
+	IdleTimeout int
+}
+
+// AuthChallenge asks the client to prove it knows the instance password.
+// The password itself is never sent, see package auth.
+type AuthChallenge struct {
+	Nonce   []byte `json:"nonce"`
+	Setting string `json:"setting,omitempty"` // Hash setting to derive the key with, empty for plaintext passwords
+	KeyLen  int    `json:"key_len,omitempty"`
+}
+
+type AuthProof struct {
+	Proof []byte `json:"proof"`
 }
 
 type FileListRequest struct {
@@ -47,6 +106,20 @@ type AuthResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	Exclude string `json:"exclude,omitempty"`
+	// SkipCompress are the extensions configured for the instance whose
+	// data is sent uncompressed with per message compression
+	SkipCompress []string `json:"skip_compress,omitempty"`
+	// Version and Capabilities are the negotiated protocol version
+	// and the features both sides support
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Compression is the algorithm used from now on if compression was requested
+	Compression string `json:"compression,omitempty"`
+	// IdleTimeout is how many seconds the daemon waits for data before it
+	// drops the connection, 0 for no limit
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// ServerProof is auth.ServerProof if the client answered a challenge
+	ServerProof []byte `json:"server_proof,omitempty"`
 }
 
 type FileInfo struct {
@@ -63,6 +136,46 @@ type StartFileMsg struct {
 	Size    int64  `json:"size"`
 	Mode    uint32 `json:"mode"`
 	ModTime int64  `json:"mod_time"`
+	// Delta asks the receiver to reply with MsgSignature.
+	// The file content then follows as MsgDelta instead of MsgData.
+	Delta bool `json:"delta,omitempty"`
+	// Offset is where the data starts when resuming a partial file.
+	// The receiver keeps the first Offset bytes of its partial copy.
+	Offset int64 `json:"offset,omitempty"`
+	// Inplace makes the receiver write directly into the destination file
+	// instead of a temp file that is renamed when complete.
+	Inplace bool `json:"inplace,omitempty"`
+}
+
+// PartialInfo describes the prefix of a file the receiver already has
+type PartialInfo struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Hash   string `json:"hash,omitempty"` // MD5 of the first Offset bytes
+}
+
+// RangeMsg is a byte range of a file transferred in chunks
+type RangeMsg struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// RangeCommit completes a file pushed in ranges. The receiver truncates its
+// temp file to Size and only moves it into place if it hashes to Hash.
+type RangeCommit struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mod_time"`
+	Hash    string `json:"hash"` // MD5 of the whole file
+}
+
+// FileHash is the MD5 of a whole file
+type FileHash struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
 }
 
 // Transport helper
@@ -70,26 +183,61 @@ type Transport struct {
 	conn io.ReadWriteCloser
 	r    io.Reader
 	w    io.Writer
-	zw   *zlib.Writer
-	zr   io.ReadCloser
+
+	// Per message compression, see EnableMessageCompression
+	mc       *MessageCompression
+	codec    *messageCodec
+	pr       *bytes.Reader // Decompressed payload of the current message
+	skipData bool          // MsgData of the current file goes out uncompressed
+	sampled  bool          // The first MsgData of the current file was sent
+	dataBuf  []byte        // Read buffer of SendFile for compressed MsgData
+
+	// Idle timeout and heartbeat, see SetIdleTimeout and StartHeartbeat
+	dl   deadliner // The network connection, nil for other connections
+	idle time.Duration
+	pong chan struct{} // A ping waits for its answer
+	done chan struct{} // Closed with the transport
+
+	wmu      sync.Mutex // Serializes writes
+	lastSend time.Time
+	closed   bool
 }
 
 func NewTransport(conn io.ReadWriteCloser) *Transport {
+	dl, _ := conn.(deadliner)
 	return &Transport{
 		conn: conn,
 		r:    conn,
 		w:    conn,
+		dl:   dl,
 	}
 }
 
-func (t *Transport) EnableCompression() error {
-	t.zw = zlib.NewWriter(t.conn)
-	t.w = t.zw
-	// Lazy initialize zlib reader when first read is needed to avoid deadlock
-	// because zlib.NewReader tries to read header immediately.
+// EnableMessageCompression compresses the payloads of messages sent from now
+// on one by one and decompresses those of received messages flagged as
+// compressed. Payloads that don't shrink are sent as is.
+func (t *Transport) EnableMessageCompression(mc MessageCompression) error {
+	codec, err := newMessageCodec(mc.Algo, mc.Level)
+	if err != nil {
+		return err
+	}
+	t.mc = &mc
+	t.codec = codec
 	return nil
 }
 
+// BeginFile is called before the data of the file at name is sent. With per
+// message compression its data is only compressed if the extension isn't on
+// the skip list and the first MsgData compressed well.
+func (t *Transport) BeginFile(name string) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.mc != nil {
+		t.skipData = t.mc.skips(name)
+		t.sampled = false
+	}
+}
+
 func (t *Transport) SendJSON(msgType MessageType, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -99,47 +247,185 @@ func (t *Transport) SendJSON(msgType MessageType, v interface{}) error {
 }
 
 func (t *Transport) Send(msgType MessageType, data []byte) error {
-	length := uint32(len(data))
-	header := make([]byte, 5)
-	header[0] = byte(msgType)
-	binary.BigEndian.PutUint32(header[1:], length)
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.codec != nil && len(data) >= minCompressSize && !(msgType == MsgData && t.skipData) {
+		if c := t.codec.compress(data); c != nil {
+			msgType |= compressedFlag
+			data = c
+		} else if msgType == MsgData && !t.sampled {
+			// The file doesn't compress, don't try the rest of it
+			t.skipData = true
+		}
+	}
+	if msgType&^compressedFlag == MsgData {
+		t.sampled = true
+	}
 
-	if _, err := t.w.Write(header); err != nil {
+	// Header and payload go out in one write, so a message on a
+	// multiplexed stream isn't split across frames
+	msg := make([]byte, 5+len(data))
+	msg[0] = byte(msgType)
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(data)))
+	copy(msg[5:], data)
+	t.extendWrite()
+	if _, err := t.w.Write(msg); err != nil {
 		return err
 	}
-	if length > 0 {
-		if _, err := t.w.Write(data); err != nil {
+	t.lastSend = time.Now()
+	return nil
+}
+
+// SendFile sends the next n bytes of f as MsgData. On a TCP connection, or a
+// multiplexed stream over one, whose data isn't compressed the data goes from
+// the file to the socket with sendfile, without being copied through user space. Otherwise it's read
+// through buf in messages of len(buf), or of compressedDataSize if they are
+// compressed per message. An error leaves the connection in an unknown state,
+// including when f ends before n bytes.
+func (t *Transport) SendFile(f *os.File, n int64, buf []byte) error {
+	for n > 0 {
+		// Sampling the first message may turn compression off for the file
+		if t.zeroCopy() {
+			return t.sendFileRaw(f, n)
+		}
+		buf := buf
+		if t.compressesData() {
+			if t.dataBuf == nil {
+				t.dataBuf = make([]byte, compressedDataSize)
+			}
+			buf = t.dataBuf
+		}
+		m, err := io.ReadFull(f, buf[:min(int64(len(buf)), n)])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if err := t.Send(MsgData, buf[:m]); err != nil {
+			return err
+		}
+		n -= int64(m)
+	}
+	return nil
+}
+
+// rawData reports whether MsgData is currently sent uncompressed
+func (t *Transport) rawData() bool {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.codec == nil || t.skipData
+}
+
+// compressesData reports whether MsgData is currently compressed per message
+func (t *Transport) compressesData() bool {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.codec != nil && !t.skipData
+}
+
+// zeroCopy reports whether MsgData can currently be sent with sendfile: it
+// goes out uncompressed, straight to a TCP connection or in the frames of a
+// multiplexed stream whose connection is such a transport
+func (t *Transport) zeroCopy() bool {
+	if !t.rawData() {
+		return false
+	}
+	switch c := t.conn.(type) {
+	case *net.TCPConn:
+		return true
+	case *Stream:
+		return c.m.t.zeroCopy()
+	}
+	return false
+}
+
+// sendFileRaw sends n bytes of f with sendfile
+func (t *Transport) sendFileRaw(f *os.File, n int64) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	for n > 0 {
+		frame := min(n, DataFrameSize)
+		if err := t.sendFileMsg(MsgData, nil, f, frame); err != nil {
 			return err
 		}
+		n -= frame
+	}
+	return nil
+}
+
+// sendFileMsg sends a message of prefix followed by the next n bytes of f,
+// which go out with sendfile. wmu must be held.
+func (t *Transport) sendFileMsg(msgType MessageType, prefix []byte, f *os.File, n int64) error {
+	header := make([]byte, 5+len(prefix))
+	header[0] = byte(msgType)
+	binary.BigEndian.PutUint32(header[1:], uint32(int64(len(prefix))+n))
+	copy(header[5:], prefix)
+	t.extendWrite()
+	if _, err := t.conn.Write(header); err != nil {
+		return err
 	}
-	if t.zw != nil {
-		return t.zw.Flush()
+	var written int64
+	var err error
+	if s, ok := t.conn.(*Stream); ok {
+		written, err = s.sendFile(f, n)
+	} else {
+		// net.TCPConn uses sendfile for an *os.File behind an io.LimitedReader
+		written, err = io.CopyN(t.conn, f, n)
 	}
+	if err == io.EOF || (err == nil && written < n) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	t.lastSend = time.Now()
 	return nil
 }
 
 func (t *Transport) ReadHeader() (MessageType, uint32, error) {
-	if t.zw != nil && t.zr == nil {
-		var err error
-		t.zr, err = zlib.NewReader(t.conn)
-		if err != nil {
+	t.pr = nil
+
+	header := make([]byte, 5)
+	for {
+		t.extendRead()
+		if _, err := io.ReadFull(t.r, header); err != nil {
 			return 0, 0, err
 		}
-		t.r = t.zr
+		msgType := MessageType(header[0])
+		length := binary.BigEndian.Uint32(header[1:])
+
+		if length > MaxMessageSize {
+			return 0, 0, fmt.Errorf("message too large: %d > %d", length, MaxMessageSize)
+		}
+		if heartbeat, err := t.handleHeartbeat(msgType, length); err != nil {
+			return 0, 0, err
+		} else if !heartbeat {
+			return t.readPayload(msgType, length)
+		}
 	}
+}
 
-	header := make([]byte, 5)
-	if _, err := io.ReadFull(t.r, header); err != nil {
+// readPayload decompresses the payload of a compressed message, so it is
+// read from GetConn like any other
+func (t *Transport) readPayload(msgType MessageType, length uint32) (MessageType, uint32, error) {
+	if msgType&compressedFlag == 0 {
+		return msgType, length, nil
+	}
+	if t.codec == nil {
+		return 0, 0, fmt.Errorf("compressed message without compression enabled")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(t.r, data); err != nil {
 		return 0, 0, err
 	}
-	msgType := MessageType(header[0])
-	length := binary.BigEndian.Uint32(header[1:])
-
-	if length > MaxMessageSize {
-		return 0, 0, fmt.Errorf("message too large: %d > %d", length, MaxMessageSize)
+	data, err := t.codec.decompress(data)
+	if err != nil {
+		return 0, 0, err
 	}
-
-	return msgType, length, nil
+	// The payload is read from pr through GetConn
+	t.pr = bytes.NewReader(data)
+	return msgType &^ compressedFlag, uint32(len(data)), nil
 }
 
 func (t *Transport) ReadJSON(v interface{}) (MessageType, error) {
@@ -148,7 +434,7 @@ func (t *Transport) ReadJSON(v interface{}) (MessageType, error) {
 		return 0, err
 	}
 	data := make([]byte, length)
-	if _, err := io.ReadFull(t.r, data); err != nil {
+	if _, err := io.ReadFull(t.GetConn(), data); err != nil {
 		return msgType, err
 	}
 	if err := json.Unmarshal(data, v); err != nil {
@@ -163,22 +449,84 @@ func (t *Transport) ReadData() (MessageType, []byte, error) {
 		return 0, nil, err
 	}
 	data := make([]byte, length)
-	if _, err := io.ReadFull(t.r, data); err != nil {
+	if _, err := io.ReadFull(t.GetConn(), data); err != nil {
 		return msgType, nil, err
 	}
 	return msgType, data, nil
 }
 
-func (t *Transport) Close() error {
-	if t.zw != nil {
-		t.zw.Close()
+// ReceiveData copies the MsgData messages of a file to w up to MsgEndFile
+// and returns the payload of MsgEndFile. progress, if set, is called with the
+// bytes written. Copying to an *os.File lets the kernel splice the data from
+// an uncompressed TCP connection. If writing fails, the rest of the data is
+// read and dropped and the write error returned as writeErr. err means the
+// connection failed or sent something else, it can't be used afterwards.
+func (t *Transport) ReceiveData(w io.Writer, progress func(int64)) (end []byte, writeErr, err error) {
+	for {
+		mt, length, err := t.ReadHeader()
+		if err != nil {
+			return nil, writeErr, err
+		}
+		switch mt {
+		case MsgData:
+		case MsgEndFile:
+			end = make([]byte, length)
+			_, err = io.ReadFull(t.GetConn(), end)
+			return end, writeErr, err
+		default:
+			return nil, writeErr, fmt.Errorf("unexpected message type %v", mt)
+		}
+
+		// The limited reader tracks what is left of the message after a
+		// failed write, the kernel updates it when splicing too
+		lr := &io.LimitedReader{R: t.GetConn(), N: int64(length)}
+		if writeErr == nil {
+			var n int64
+			n, writeErr = io.Copy(w, lr)
+			if progress != nil {
+				progress(n)
+			}
+		}
+		if _, err := io.Copy(io.Discard, lr); err != nil {
+			return nil, writeErr, err
+		}
+		if lr.N > 0 {
+			return nil, writeErr, io.ErrUnexpectedEOF
+		}
 	}
-	if t.zr != nil {
-		t.zr.Close()
+}
+
+// DiscardFile skips the remaining messages of a file up to MsgEndFile
+func (t *Transport) DiscardFile() error {
+	for {
+		mt, length, err := t.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, t.GetConn(), int64(length)); err != nil {
+			return err
+		}
+		if mt == MsgEndFile {
+			return nil
+		}
+	}
+}
+
+func (t *Transport) Close() error {
+	t.wmu.Lock()
+	if t.done != nil && !t.closed {
+		close(t.done)
 	}
+	t.closed = true
+	t.wmu.Unlock()
 	return t.conn.Close()
 }
 
+// GetConn returns the reader of the payload of the message whose header
+// ReadHeader returned
 func (t *Transport) GetConn() io.Reader {
+	if t.pr != nil {
+		return t.pr
+	}
 	return t.r
 }
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+// rateSlice is the most data read or written at once on a rate limited
+// connection, so the limiters pace the data smoothly
+const rateSlice = 32 * 1024
+
+// limitedConn throttles reads and writes of a connection with limiters.
+// Reads are paid for after they returned, writes before they start.
+// The idle timeout of t applies to each slice, not to a whole message.
+type limitedConn struct {
+	io.ReadWriteCloser
+	limiters []*utils.RateLimiter
+	t        *Transport
+}
+
+func (c *limitedConn) wait(n int) {
+	for _, l := range c.limiters {
+		l.Wait(n)
+	}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	c.t.extendRead()
+	n, err := c.ReadWriteCloser.Read(p[:min(len(p), rateSlice)])
+	c.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), rateSlice)
+		c.wait(n)
+		c.t.extendWrite()
+		m, err := c.ReadWriteCloser.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// LimitRate throttles the data sent and received from now on to the rates
+// of limiters, nil ones don't limit. The limiters may be shared by several
+// transports.
+func (t *Transport) LimitRate(limiters ...*utils.RateLimiter) {
+	var active []*utils.RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return
+	}
+	// Without a *net.TCPConn SendFile doesn't bypass the limiters with sendfile
+	t.conn = &limitedConn{ReadWriteCloser: t.conn, limiters: active, t: t}
+	t.r = t.conn
+	t.w = t.conn
+}
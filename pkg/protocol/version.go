@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	// ProtocolVersion is bumped on incompatible changes to the wire format
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version this build can still talk to
+	MinProtocolVersion = 1
+)
+
+// Capabilities are optional features. Both sides advertise what they support
+// in the handshake and only use the features they have in common.
+const (
+	CapCompressZlib   = "compress-zlib"     // zlib compression
+	CapCompressZstd   = "compress-zstd"     // zstd compression
+	CapCompressLZ4    = "compress-lz4"      // lz4 compression
+	CapHashMD5        = "hash-md5"          // MD5 file hashes for checksum comparison
+	CapDelta          = "delta"             // MsgSignature / MsgDelta transfers
+	CapResume         = "resume"            // MsgPartialReq / MsgResumeReq
+	CapFileList       = "filelist"          // File list in batches followed by MsgFileListEnd
+	CapFileListBinary = "filelist-binary"   // File list batches use EncodeFileList instead of JSON
+	CapMux            = "mux"               // Concurrent streams on one connection, see Mux
+	CapRanges         = "ranges"            // Chunked transfers, MsgRangeReq / MsgRangeStart / MsgRangeCommit / MsgHashReq
+	CapCompressMsgs   = "compress-messages" // Compression per message instead of the stream, see EnableMessageCompression
+	CapVerify         = "verify"            // Hash in MsgEndFile, answered with MsgFileAck / MsgFileNack
+	CapResults        = "results"           // MsgDeleteFile answered with MsgFileAck / MsgFileNack
+	CapErrors         = "errors"            // MsgError carries an ErrorMsg instead of plain text
+	CapHeartbeat      = "heartbeat"         // MsgPing / MsgPong keep idle connections alive, see StartHeartbeat
+)
+
+// Capabilities returns the features supported by this build
+func Capabilities() []string {
+	return []string{CapCompressZlib, CapCompressZstd, CapCompressLZ4, CapHashMD5, CapDelta, CapResume, CapFileList, CapFileListBinary, CapMux, CapRanges, CapCompressMsgs, CapVerify, CapResults, CapErrors, CapHeartbeat}
+}
+
+// NegotiateVersion picks the version to speak with a peer announcing remote.
+// Peers from before versioning announce 0.
+func NegotiateVersion(remote int) (int, error) {
+	if remote < MinProtocolVersion {
+		supported := fmt.Sprint(ProtocolVersion)
+		if MinProtocolVersion != ProtocolVersion {
+			supported = fmt.Sprintf("%d to %d", MinProtocolVersion, ProtocolVersion)
+		}
+		return 0, fmt.Errorf("protocol version %d is not supported (supported: %s), please upgrade fastsync", remote, supported)
+	}
+	return min(remote, ProtocolVersion), nil
+}
+
+// NegotiateCapabilities returns the capabilities in both local and remote
+func NegotiateCapabilities(local, remote []string) []string {
+	common := []string{}
+	for _, c := range local {
+		if slices.Contains(remote, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// HasCapability reports whether c is in caps
+func HasCapability(caps []string, c string) bool {
+	return slices.Contains(caps, c)
+}
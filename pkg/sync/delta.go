@@ -0,0 +1,399 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	minBlockSize = 700
+	maxBlockSize = 128 * 1024
+	// maxGrownBlockSize is the largest block size BlockSizeFor picks for
+	// very large files. Larger ones are rejected, the sender buffers blocks.
+	maxGrownBlockSize = 16 * 1024 * 1024
+	// maxBlocks keeps an encoded signature well below protocol.MaxMessageSize
+	maxBlocks = 400 * 1024
+	// maxLiteral is the largest literal run emitted in a single DeltaOp
+	maxLiteral = 32 * 1024
+
+	blockSigSize = 4 + md5.Size
+	sigHeaderLen = 4 + 8 + 4
+
+	opLiteral byte = 0
+	opCopy    byte = 1
+)
+
+// BlockSig is the signature of a single block of the basis file
+type BlockSig struct {
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+// Signature describes the basis file the receiver already has.
+// The sender uses it to find blocks that don't need to be transferred.
+type Signature struct {
+	BlockSize int
+	Size      int64 // Size of the basis file
+	Blocks    []BlockSig
+}
+
+// DeltaOp is a single instruction for rebuilding the source file.
+// Either Literal data is written as is, or Count blocks starting at Index
+// are copied from the basis file.
+type DeltaOp struct {
+	Literal []byte
+	Index   uint32
+	Count   uint32
+}
+
+// BlockSizeFor picks a block size for a basis file of the given size,
+// roughly the square root of the file size like rsync does.
+func BlockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 7) &^ 7
+	if bs < minBlockSize {
+		bs = minBlockSize
+	}
+	if bs > maxBlockSize {
+		bs = maxBlockSize
+	}
+	// Very large files would exceed the signature size limit, grow the blocks instead
+	for size/int64(bs) > maxBlocks && bs < maxGrownBlockSize {
+		bs *= 2
+	}
+	return bs
+}
+
+// rollingSum is the rsync weak checksum, cheap to update one byte at a time
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(p []byte) rollingSum {
+	var s rollingSum
+	s.n = uint32(len(p))
+	for i, c := range p {
+		s.a += uint32(c)
+		s.b += uint32(len(p)-i) * uint32(c)
+	}
+	return s
+}
+
+// roll removes the first byte of the window and optionally appends a new one
+func (s *rollingSum) roll(out byte, in byte, hasIn bool) {
+	s.a -= uint32(out)
+	s.b -= s.n * uint32(out)
+	s.n--
+	if hasIn {
+		s.a += uint32(in)
+		s.b += s.a
+		s.n++
+	}
+}
+
+func (s rollingSum) digest() uint32 {
+	return (s.a & 0xffff) | (s.b&0xffff)<<16
+}
+
+// ComputeSignature reads the basis file and returns its block signatures.
+// It fails for files with more blocks than a signature may have.
+func ComputeSignature(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if len(sig.Blocks) == maxBlocks {
+				return nil, fmt.Errorf("basis file too large for a signature")
+			}
+			sig.Blocks = append(sig.Blocks, BlockSig{
+				Weak:   newRollingSum(buf[:n]).digest(),
+				Strong: md5.Sum(buf[:n]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Signature) blockLen(i int) int {
+	if i == len(s.Blocks)-1 {
+		return int(s.Size - int64(i)*int64(s.BlockSize))
+	}
+	return s.BlockSize
+}
+
+func (s *Signature) MarshalBinary() ([]byte, error) {
+	data := make([]byte, sigHeaderLen+len(s.Blocks)*blockSigSize)
+	binary.BigEndian.PutUint32(data[0:], uint32(s.BlockSize))
+	binary.BigEndian.PutUint64(data[4:], uint64(s.Size))
+	binary.BigEndian.PutUint32(data[12:], uint32(len(s.Blocks)))
+	off := sigHeaderLen
+	for _, b := range s.Blocks {
+		binary.BigEndian.PutUint32(data[off:], b.Weak)
+		copy(data[off+4:], b.Strong[:])
+		off += blockSigSize
+	}
+	return data, nil
+}
+
+func (s *Signature) UnmarshalBinary(data []byte) error {
+	if len(data) < sigHeaderLen {
+		return fmt.Errorf("signature too short")
+	}
+	s.BlockSize = int(binary.BigEndian.Uint32(data[0:]))
+	s.Size = int64(binary.BigEndian.Uint64(data[4:]))
+	count := int(binary.BigEndian.Uint32(data[12:]))
+	// The block size bounds what the sender buffers, the peer picks it
+	if s.BlockSize <= 0 || s.BlockSize > maxGrownBlockSize || s.Size < 0 || count > maxBlocks {
+		return fmt.Errorf("malformed signature")
+	}
+	if len(data) != sigHeaderLen+count*blockSigSize {
+		return fmt.Errorf("malformed signature")
+	}
+	if int64(count) != (s.Size+int64(s.BlockSize)-1)/int64(s.BlockSize) {
+		return fmt.Errorf("signature block count mismatch")
+	}
+	s.Blocks = make([]BlockSig, count)
+	off := sigHeaderLen
+	for i := range s.Blocks {
+		s.Blocks[i].Weak = binary.BigEndian.Uint32(data[off:])
+		copy(s.Blocks[i].Strong[:], data[off+4:off+blockSigSize])
+		off += blockSigSize
+	}
+	return nil
+}
+
+// ComputeDelta reads the source file and calls emit with the instructions
+// needed to rebuild it from the basis described by sig.
+// Literal slices are only valid until emit returns.
+func ComputeDelta(r io.Reader, sig *Signature, emit func(DeltaOp) error) error {
+	if len(sig.Blocks) == 0 {
+		// Nothing to match against, send everything as literals
+		buf := make([]byte, maxLiteral)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if err := emit(DeltaOp{Literal: buf[:n]}); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	bs := sig.BlockSize
+	br := bufio.NewReaderSize(r, 256*1024)
+	// data holds the pending literal followed by the current window
+	data := make([]byte, 0, maxLiteral+2*bs)
+	winStart := 0
+	eof := false
+
+	var pending DeltaOp // Buffered copy op, so adjacent blocks are merged
+	flushCopy := func() error {
+		if pending.Count == 0 {
+			return nil
+		}
+		op := pending
+		pending = DeltaOp{}
+		return emit(op)
+	}
+	flushLiteral := func() error {
+		if winStart == 0 {
+			return nil
+		}
+		if err := flushCopy(); err != nil {
+			return err
+		}
+		if err := emit(DeltaOp{Literal: data[:winStart]}); err != nil {
+			return err
+		}
+		data = append(data[:0], data[winStart:]...)
+		winStart = 0
+		return nil
+	}
+	fill := func() error {
+		for !eof && len(data) < winStart+bs+1 {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			data = append(data, c)
+		}
+		return nil
+	}
+
+	var sum rollingSum
+	valid := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		winLen := len(data) - winStart
+		if winLen > bs {
+			winLen = bs
+		}
+		if winLen == 0 {
+			break
+		}
+		window := data[winStart : winStart+winLen]
+		if !valid {
+			sum = newRollingSum(window)
+			valid = true
+		}
+
+		match := -1
+		if candidates, ok := index[sum.digest()]; ok {
+			strong := md5.Sum(window)
+			for _, i := range candidates {
+				if sig.blockLen(i) == winLen && bytes.Equal(sig.Blocks[i].Strong[:], strong[:]) {
+					match = i
+					break
+				}
+			}
+		}
+
+		if match >= 0 {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			if pending.Count > 0 && pending.Index+pending.Count == uint32(match) {
+				pending.Count++
+			} else {
+				if err := flushCopy(); err != nil {
+					return err
+				}
+				pending = DeltaOp{Index: uint32(match), Count: 1}
+			}
+			data = append(data[:0], data[winLen:]...)
+			valid = false
+			continue
+		}
+
+		// No match, move the window forward by one byte
+		out := data[winStart]
+		winStart++
+		if winStart+winLen <= len(data) {
+			sum.roll(out, data[winStart+winLen-1], true)
+		} else {
+			sum.roll(out, 0, false)
+		}
+		if winStart >= maxLiteral {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flushLiteral(); err != nil {
+		return err
+	}
+	return flushCopy()
+}
+
+func (op DeltaOp) MarshalBinary() ([]byte, error) {
+	if op.Count == 0 {
+		data := make([]byte, 1+len(op.Literal))
+		data[0] = opLiteral
+		copy(data[1:], op.Literal)
+		return data, nil
+	}
+	data := make([]byte, 9)
+	data[0] = opCopy
+	binary.BigEndian.PutUint32(data[1:], op.Index)
+	binary.BigEndian.PutUint32(data[5:], op.Count)
+	return data, nil
+}
+
+func (op *DeltaOp) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty delta op")
+	}
+	switch data[0] {
+	case opLiteral:
+		op.Literal = data[1:]
+		op.Index, op.Count = 0, 0
+	case opCopy:
+		if len(data) != 9 {
+			return fmt.Errorf("malformed copy op")
+		}
+		op.Literal = nil
+		op.Index = binary.BigEndian.Uint32(data[1:])
+		op.Count = binary.BigEndian.Uint32(data[5:])
+		if op.Count == 0 {
+			return fmt.Errorf("malformed copy op")
+		}
+	default:
+		return fmt.Errorf("unknown delta op %d", data[0])
+	}
+	return nil
+}
+
+// DeltaApplier rebuilds the source file from the basis file and delta ops
+type DeltaApplier struct {
+	basis io.ReaderAt
+	sig   *Signature
+	w     io.Writer
+	buf   []byte
+}
+
+func NewDeltaApplier(basis io.ReaderAt, sig *Signature, w io.Writer) *DeltaApplier {
+	return &DeltaApplier{basis: basis, sig: sig, w: w}
+}
+
+// Apply writes the data described by op and returns the number of bytes written
+func (a *DeltaApplier) Apply(op DeltaOp) (int64, error) {
+	if op.Count == 0 {
+		n, err := a.w.Write(op.Literal)
+		return int64(n), err
+	}
+
+	if int(op.Index)+int(op.Count) > len(a.sig.Blocks) {
+		return 0, fmt.Errorf("delta references block %d beyond basis", op.Index+op.Count-1)
+	}
+	if a.basis == nil {
+		return 0, fmt.Errorf("delta references missing basis file")
+	}
+	offset := int64(op.Index) * int64(a.sig.BlockSize)
+	length := int64(op.Count) * int64(a.sig.BlockSize)
+	if offset+length > a.sig.Size {
+		length = a.sig.Size - offset
+	}
+	n, err := io.CopyBuffer(a.w, io.NewSectionReader(a.basis, offset, length), a.buffer())
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (a *DeltaApplier) buffer() []byte {
+	if a.buf == nil {
+		a.buf = make([]byte, 32*1024)
+	}
+	return a.buf
+}
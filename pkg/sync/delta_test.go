@@ -0,0 +1,227 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip sends src as a delta against basis through the wire encoding of
+// the signature and ops and returns the rebuilt file and the literal bytes
+func roundTrip(t *testing.T, basis, src []byte, blockSize int) ([]byte, int) {
+	t.Helper()
+	sig, err := ComputeSignature(bytes.NewReader(basis), blockSize)
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	data, err := sig.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received Signature
+	if err := received.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unmarshal signature: %v", err)
+	}
+
+	var out bytes.Buffer
+	applier := NewDeltaApplier(bytes.NewReader(basis), &received, &out)
+	literal := 0
+	err = ComputeDelta(bytes.NewReader(src), &received, func(op DeltaOp) error {
+		data, err := op.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		var decoded DeltaOp
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		literal += len(decoded.Literal)
+		_, err = applier.Apply(decoded)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("delta: %v", err)
+	}
+	return out.Bytes(), literal
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const bs = minBlockSize
+	basis := randomBytes(1, 50*bs+123) // The last block is partial
+	other := randomBytes(2, 20*bs)
+
+	modified := bytes.Clone(basis)
+	copy(modified[10*bs+5:], "changed in the middle")
+
+	// The partial last block of the basis only matches at the end of the source
+	tail := len(basis) % bs
+	tests := []struct {
+		name       string
+		basis, src []byte
+		maxLiteral int // Upper bound of the literal data sent
+	}{
+		{"identical", basis, basis, 0},
+		{"empty basis", nil, other, len(other)},
+		{"empty source", basis, nil, 0},
+		{"both empty", nil, nil, 0},
+		{"appended", basis, concat(basis, other[:1000]), tail + 1000},
+		{"prepended", basis, concat(other[:1000], basis), 1000},
+		{"modified block", basis, modified, bs},
+		{"blocks reordered", basis, concat(basis[20*bs:30*bs], basis[:20*bs], basis[30*bs:]), 0},
+		{"block repeated", basis, concat(basis[:bs], basis[:bs], basis[:bs]), 0},
+		{"partial last block moved", basis, concat(basis[50*bs:], basis[:50*bs]), tail},
+		{"unrelated", basis, other, len(other)},
+		{"shorter than a block", basis, basis[:bs/2], bs / 2},
+		{"source truncated", basis, basis[:25*bs+7], 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, literal := roundTrip(t, tt.basis, tt.src, bs)
+			if !bytes.Equal(got, tt.src) {
+				t.Fatalf("rebuilt %d bytes that differ from the %d byte source", len(got), len(tt.src))
+			}
+			if literal > tt.maxLiteral {
+				t.Fatalf("sent %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestDeltaRoundTripBlockSizes(t *testing.T) {
+	src := randomBytes(3, 300*1024)
+	basis := concat(src[:100*1024], randomBytes(4, 5000), src[100*1024:])
+	for _, bs := range []int{minBlockSize, 4096, BlockSizeFor(int64(len(basis))), maxBlockSize} {
+		got, _ := roundTrip(t, basis, src, bs)
+		if !bytes.Equal(got, src) {
+			t.Fatalf("block size %d: rebuilt file differs", bs)
+		}
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minBlockSize},
+		{1000, minBlockSize},
+		{1 << 20, 1024},
+		{1 << 35, maxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSizeFor(tt.size); got != tt.want {
+			t.Errorf("BlockSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+	// Huge files grow the block size to stay within maxBlocks
+	for _, size := range []int64{1 << 36, 1 << 42, 1 << 46} {
+		bs := BlockSizeFor(size)
+		if bs > maxGrownBlockSize || (bs < maxGrownBlockSize && (size+int64(bs)-1)/int64(bs) > maxBlocks) {
+			t.Errorf("BlockSizeFor(%d) = %d", size, bs)
+		}
+	}
+}
+
+// sigHeader encodes a signature header announcing count blocks, followed by
+// blocks zeroed block signatures
+func sigHeader(blockSize uint32, size uint64, count uint32, blocks int) []byte {
+	data := make([]byte, sigHeaderLen+blocks*blockSigSize)
+	binary.BigEndian.PutUint32(data[0:], blockSize)
+	binary.BigEndian.PutUint64(data[4:], size)
+	binary.BigEndian.PutUint32(data[12:], count)
+	return data
+}
+
+func TestSignatureUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", make([]byte, sigHeaderLen-1)},
+		{"zero block size", sigHeader(0, 0, 0, 0)},
+		{"block size too large", sigHeader(maxGrownBlockSize+1, maxGrownBlockSize+1, 1, 1)},
+		{"huge block size", sigHeader(1<<31, 1, 1, 1)},
+		{"negative size", sigHeader(1024, 1<<63, 0, 0)},
+		{"too many blocks", sigHeader(1024, 1024*(maxBlocks+1), maxBlocks+1, 0)},
+		{"missing blocks", sigHeader(1024, 4096, 4, 3)},
+		{"extra data", append(sigHeader(1024, 1024, 1, 1), 0)},
+		{"count below size", sigHeader(1024, 4096, 3, 3)},
+		{"count above size", sigHeader(1024, 1024, 2, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sig Signature
+			if err := sig.UnmarshalBinary(tt.data); err == nil {
+				t.Fatalf("accepted signature with block size %d, size %d and %d blocks", sig.BlockSize, sig.Size, len(sig.Blocks))
+			}
+		})
+	}
+
+	var sig Signature
+	if err := sig.UnmarshalBinary(sigHeader(maxGrownBlockSize, maxGrownBlockSize, 1, 1)); err != nil {
+		t.Fatalf("largest block size rejected: %v", err)
+	}
+}
+
+func TestDeltaOpUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown op", []byte{2}},
+		{"short copy", []byte{opCopy, 0, 0, 0, 1, 0, 0, 0}},
+		{"long copy", []byte{opCopy, 0, 0, 0, 1, 0, 0, 0, 1, 0}},
+		{"copy of nothing", []byte{opCopy, 0, 0, 0, 1, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var op DeltaOp
+			if err := op.UnmarshalBinary(tt.data); err == nil {
+				t.Fatalf("accepted %+v", op)
+			}
+		})
+	}
+}
+
+func TestDeltaApplyOutOfRange(t *testing.T) {
+	basis := randomBytes(5, 4*minBlockSize)
+	sig, err := ComputeSignature(bytes.NewReader(basis), minBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		basis []byte
+		op    DeltaOp
+	}{
+		{"past the last block", basis, DeltaOp{Index: 4, Count: 1}},
+		{"run past the end", basis, DeltaOp{Index: 2, Count: 3}},
+		{"index overflow", basis, DeltaOp{Index: 1<<32 - 1, Count: 2}},
+		{"missing basis", nil, DeltaOp{Index: 0, Count: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := NewDeltaApplier(nil, sig, &out)
+			if tt.basis != nil {
+				a = NewDeltaApplier(bytes.NewReader(tt.basis), sig, &out)
+			}
+			if _, err := a.Apply(tt.op); err == nil {
+				t.Fatalf("applied %+v", tt.op)
+			}
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package sync
 
 import (
+	"fmt"
+	"iter"
+	"strings"
+
 	"github.com/taurusxin/fastsync/pkg/protocol"
 )
 
 type Options struct {
-	Delete    bool
-	Overwrite bool
-	Checksum  bool
-	Compress  bool
-	Archive   bool
+	Delete       bool
+	Overwrite    bool
+	Checksum     bool
+	Compress     bool
+	Archive      bool
+	SizeOnly     bool  // Only compare sizes, ignore modification times
+	IgnoreTimes  bool  // Never skip files, even if size and time match
+	ModifyWindow int64 // Allowed ModTime difference in seconds
 }
 
 type ActionType int
@@ -27,60 +34,185 @@ type FileAction struct {
 	Info   protocol.FileInfo // Source info for copy, Target info for delete
 }
 
-func Compare(source, target []protocol.FileInfo, opts Options) []FileAction {
-	targetMap := make(map[string]protocol.FileInfo)
-	for _, f := range target {
-		targetMap[f.Path] = f
+// FileIter yields file infos in ComparePaths order. An error ends the sequence.
+type FileIter = iter.Seq2[protocol.FileInfo, error]
+
+// FileList yields the entries of files, which must already be in ComparePaths order
+func FileList(files []protocol.FileInfo) FileIter {
+	return func(yield func(protocol.FileInfo, error) bool) {
+		for _, f := range files {
+			if !yield(f, nil) {
+				return
+			}
+		}
 	}
+}
 
-	var actions []FileAction
+// ComparePaths orders slash separated paths component by component,
+// which is the order filepath.Walk visits them in. A directory sorts
+// before its contents, and "a/b" before "a.txt".
+func ComparePaths(a, b string) int {
+	for {
+		ai := strings.IndexByte(a, '/')
+		bi := strings.IndexByte(b, '/')
+		ac, bc := a, b
+		if ai >= 0 {
+			ac = a[:ai]
+		}
+		if bi >= 0 {
+			bc = b[:bi]
+		}
+		if c := strings.Compare(ac, bc); c != 0 {
+			return c
+		}
+		switch {
+		case ai < 0 && bi < 0:
+			return 0
+		case ai < 0:
+			return -1
+		case bi < 0:
+			return 1
+		}
+		a, b = a[ai+1:], b[bi+1:]
+	}
+}
 
-	// Check Source -> Target
-	for _, src := range source {
-		tgt, exists := targetMap[src.Path]
+// cursor walks a FileIter one entry at a time and checks its order
+type cursor struct {
+	next func() (protocol.FileInfo, error, bool)
+	stop func()
+	cur  protocol.FileInfo
+	ok   bool
+}
 
-		if !exists {
-			actions = append(actions, FileAction{Path: src.Path, Type: ActionCopy, Reason: "new", Info: src})
-			continue
-		}
+func newCursor(files FileIter) (*cursor, error) {
+	next, stop := iter.Pull2(files)
+	c := &cursor{next: next, stop: stop}
+	return c, c.advance()
+}
 
-		if src.IsDir {
-			continue
-		}
+func (c *cursor) advance() error {
+	fi, err, ok := c.next()
+	if !ok {
+		c.ok = false
+		return nil
+	}
+	if err != nil {
+		c.ok = false
+		return err
+	}
+	if c.ok && ComparePaths(c.cur.Path, fi.Path) >= 0 {
+		c.ok = false
+		return fmt.Errorf("file list out of order at %s", fi.Path)
+	}
+	c.cur, c.ok = fi, true
+	return nil
+}
 
-		// File exists
-		if opts.Overwrite {
-			actions = append(actions, FileAction{Path: src.Path, Type: ActionCopy, Reason: "overwrite", Info: src})
-			continue
+// ActionIter yields the actions of a comparison. An error ends the sequence.
+type ActionIter = iter.Seq2[FileAction, error]
+
+// Compare merges the source and target file lists and yields the actions
+// needed to bring target up to date, in ComparePaths order. The lists are
+// consumed as the actions are, so nothing is kept in memory here. A deleted
+// directory is yielded before its contents, which must be deleted first.
+func Compare(source, target FileIter, opts Options) ActionIter {
+	return func(yield func(FileAction, error) bool) {
+		src, err := newCursor(source)
+		defer src.stop()
+		if err != nil {
+			yield(FileAction{}, err)
+			return
 		}
+		tgt, err := newCursor(target)
+		defer tgt.stop()
+		if err != nil {
+			yield(FileAction{}, err)
+			return
+		}
+
+		for src.ok || tgt.ok {
+			var c int
+			switch {
+			case !tgt.ok:
+				c = -1
+			case !src.ok:
+				c = 1
+			default:
+				c = ComparePaths(src.cur.Path, tgt.cur.Path)
+			}
 
-		if opts.Checksum {
-			// If hashes are available and different
-			if src.Hash != "" && tgt.Hash != "" && src.Hash != tgt.Hash {
-				actions = append(actions, FileAction{Path: src.Path, Type: ActionCopy, Reason: "checksum_diff", Info: src})
-				continue
-			} else if src.Hash == "" || tgt.Hash == "" {
-				// Fallback if hash missing? Or skip?
-				// If we requested checksum but failed to calculate, maybe skip or warn.
+			var a *FileAction
+			switch {
+			case c < 0:
+				// Missing in target
+				a = &FileAction{Path: src.cur.Path, Type: ActionCopy, Reason: "new", Info: src.cur}
+				err = src.advance()
+			case c > 0:
+				// Missing in source
+				if opts.Delete {
+					a = &FileAction{Path: tgt.cur.Path, Type: ActionDelete, Reason: "extraneous", Info: tgt.cur}
+				}
+				err = tgt.advance()
+			default:
+				if !src.cur.IsDir {
+					if reason := changeReason(src.cur, tgt.cur, opts); reason != "" {
+						a = &FileAction{Path: src.cur.Path, Type: ActionCopy, Reason: reason, Info: src.cur}
+					}
+				}
+				if err = src.advance(); err == nil {
+					err = tgt.advance()
+				}
+			}
+			if a != nil && !yield(*a, nil) {
+				return
+			}
+			if err != nil {
+				yield(FileAction{}, err)
+				return
 			}
 		}
+	}
+}
 
-		// "Otherwise ignore" -> Skip
+// changeReason decides whether an existing target file must be updated.
+// It returns an empty string when the file is considered up to date.
+// The default is an rsync-style quick check on size and ModTime.
+func changeReason(src, tgt protocol.FileInfo, opts Options) string {
+	if opts.Overwrite {
+		return "overwrite"
+	}
+	if opts.IgnoreTimes {
+		return "ignore_times"
 	}
 
-	// Check Target -> Source (for Delete)
-	if opts.Delete {
-		sourceMap := make(map[string]bool)
-		for _, f := range source {
-			sourceMap[f.Path] = true
+	if opts.Checksum {
+		if src.Size != tgt.Size {
+			return "size_diff"
 		}
-
-		for _, tgt := range target {
-			if !sourceMap[tgt.Path] {
-				actions = append(actions, FileAction{Path: tgt.Path, Type: ActionDelete, Reason: "extraneous", Info: tgt})
+		// If hashes are available and different
+		if src.Hash != "" && tgt.Hash != "" {
+			if src.Hash != tgt.Hash {
+				return "checksum_diff"
 			}
+			return ""
 		}
+		// Hash missing on one side, fall back to the quick check
+	}
+
+	if src.Size != tgt.Size {
+		return "size_diff"
+	}
+	if opts.SizeOnly {
+		return ""
 	}
 
-	return actions
+	diff := src.ModTime - tgt.ModTime
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > opts.ModifyWindow {
+		return "time_diff"
+	}
+	return ""
 }
@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/taurusxin/fastsync/pkg/protocol"
+)
+
+func TestComparePaths(t *testing.T) {
+	// In the order filepath.Walk visits them
+	ordered := []string{"", "a", "a/b", "a/b/c", "a/c", "a.txt", "a0", "b", "b/a", "é"}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if c := ComparePaths(a, b); c != want {
+				t.Errorf("ComparePaths(%q, %q) = %d, want %d", a, b, c, want)
+			}
+		}
+	}
+}
+
+// actions lists the type and path of the actions of comparing source and target
+func actions(t *testing.T, source, target []protocol.FileInfo, opts Options) []string {
+	t.Helper()
+	var got []string
+	for a, err := range Compare(FileList(source), FileList(target), opts) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, []string{"copy", "delete", "skip"}[a.Type]+" "+a.Path)
+	}
+	return got
+}
+
+func TestCompareMerge(t *testing.T) {
+	dir := protocol.FileInfo{IsDir: true}
+	file := protocol.FileInfo{Size: 1, ModTime: 100}
+	with := func(fi protocol.FileInfo, path string) protocol.FileInfo {
+		fi.Path = path
+		return fi
+	}
+	changed := with(file, "sub/changed")
+	changed.Size = 2
+
+	source := []protocol.FileInfo{
+		with(file, "a"),
+		with(dir, "new"),
+		with(file, "new/f"),
+		with(dir, "sub"),
+		changed,
+		with(file, "sub/same"),
+		with(file, "z"),
+	}
+	target := []protocol.FileInfo{
+		with(file, "a"),
+		with(dir, "gone"),
+		with(file, "gone/f"),
+		with(dir, "sub"),
+		with(file, "sub/changed"),
+		with(file, "sub/extra"),
+		with(file, "sub/same"),
+	}
+
+	// Actions come in walk order, a deleted directory before its contents
+	got := actions(t, source, target, Options{Delete: true})
+	want := []string{"delete gone", "delete gone/f", "copy new", "copy new/f", "copy sub/changed", "delete sub/extra", "copy z"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("actions %q, want %q", got, want)
+	}
+
+	got = actions(t, source, target, Options{})
+	want = []string{"copy new", "copy new/f", "copy sub/changed", "copy z"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("actions without Delete %q, want %q", got, want)
+	}
+}
+
+func TestCompareErrors(t *testing.T) {
+	unordered := FileList([]protocol.FileInfo{{Path: "b"}, {Path: "a"}})
+	failing := func(yield func(protocol.FileInfo, error) bool) {
+		if yield(protocol.FileInfo{Path: "a"}, nil) {
+			yield(protocol.FileInfo{}, errors.New("read failed"))
+		}
+	}
+	for name, list := range map[string]FileIter{"out of order": unordered, "failing": failing} {
+		for _, tt := range [][2]FileIter{{list, FileList(nil)}, {FileList(nil), list}} {
+			var err error
+			for _, err = range Compare(tt[0], tt[1], Options{Delete: true}) {
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Errorf("%s file list compared without an error", name)
+			}
+		}
+	}
+}
+
+func TestChangeReason(t *testing.T) {
+	src := protocol.FileInfo{Path: "f", Size: 10, ModTime: 1000, Hash: "0cc175b9c0f1b6a831c399e269772661"}
+	with := func(size, modTime int64, hash string) protocol.FileInfo {
+		return protocol.FileInfo{Path: "f", Size: size, ModTime: modTime, Hash: hash}
+	}
+	tests := []struct {
+		name string
+		tgt  protocol.FileInfo
+		opts Options
+		want string
+	}{
+		{"same", with(10, 1000, ""), Options{}, ""},
+		{"size", with(11, 1000, ""), Options{}, "size_diff"},
+		{"newer target", with(10, 1001, ""), Options{}, "time_diff"},
+		{"older target", with(10, 999, ""), Options{}, "time_diff"},
+		{"within window", with(10, 1002, ""), Options{ModifyWindow: 2}, ""},
+		{"within window before", with(10, 998, ""), Options{ModifyWindow: 2}, ""},
+		{"past window", with(10, 1003, ""), Options{ModifyWindow: 2}, "time_diff"},
+		{"size only", with(10, 5, ""), Options{SizeOnly: true}, ""},
+		{"size only size", with(9, 1000, ""), Options{SizeOnly: true}, "size_diff"},
+		{"ignore times", with(10, 1000, ""), Options{IgnoreTimes: true}, "ignore_times"},
+		{"ignore times over size only", with(10, 1000, ""), Options{IgnoreTimes: true, SizeOnly: true}, "ignore_times"},
+		{"overwrite", with(10, 1000, ""), Options{Overwrite: true, IgnoreTimes: true}, "overwrite"},
+		{"checksum same", with(10, 5, src.Hash), Options{Checksum: true}, ""},
+		{"checksum differs", with(10, 1000, "4a8a08f09d37b73795649038408b5f33"), Options{Checksum: true}, "checksum_diff"},
+		{"checksum size", with(11, 1000, src.Hash), Options{Checksum: true}, "size_diff"},
+		{"checksum without hash", with(10, 5, ""), Options{Checksum: true}, "time_diff"},
+		{"checksum without hash window", with(10, 1001, ""), Options{Checksum: true, ModifyWindow: 1}, ""},
+	}
+	for _, tt := range tests {
+		if got := changeReason(src, tt.tgt, tt.opts); got != tt.want {
+			t.Errorf("%s: changeReason = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/taurusxin/fastsync/pkg/protocol"
+	"github.com/taurusxin/fastsync/pkg/utils"
 )
 
 // Helper to check if file matches any exclude pattern
@@ -47,73 +48,98 @@ func isExcluded(path string, root string, excludes []string) bool {
 	return false
 }
 
+// Scan returns the whole tree below root, see Walk
 func Scan(root string, excludes []string, calcHash bool) ([]protocol.FileInfo, error) {
-	rootInfo, err := os.Stat(root)
-	if err != nil {
-		return nil, err
-	}
-
-	if !rootInfo.IsDir() {
-		// Single file
-		if isExcluded(root, root, excludes) {
-			return nil, nil
-		}
-		fi := protocol.FileInfo{
-			Path:    rootInfo.Name(),
-			Size:    rootInfo.Size(),
-			ModTime: rootInfo.ModTime().Unix(),
-			Mode:    uint32(rootInfo.Mode()),
-			IsDir:   false,
-		}
-		if calcHash {
-			hash, err := CalculateHash(root)
-			if err == nil {
-				fi.Hash = hash
-			}
+	var files []protocol.FileInfo
+	for fi, err := range Walk(root, excludes, calcHash) {
+		if err != nil {
+			return files, err
 		}
-		return []protocol.FileInfo{fi}, nil
+		files = append(files, fi)
 	}
+	return files, nil
+}
 
-	var files []protocol.FileInfo
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// Walk yields the files below root with paths relative to root.
+// Entries come in the order of ComparePaths, so two walks can be merged
+// without holding either tree in memory.
+func Walk(root string, excludes []string, calcHash bool) FileIter {
+	return func(yield func(protocol.FileInfo, error) bool) {
+		rootInfo, err := os.Stat(root)
 		if err != nil {
-			return err
+			yield(protocol.FileInfo{}, err)
+			return
 		}
-		if isExcluded(path, root, excludes) {
-			if info.IsDir() {
-				return filepath.SkipDir
+
+		if !rootInfo.IsDir() {
+			// Single file
+			if isExcluded(root, root, excludes) {
+				return
 			}
-			return nil
+			fi := protocol.FileInfo{
+				Path:    rootInfo.Name(),
+				Size:    rootInfo.Size(),
+				ModTime: rootInfo.ModTime().Unix(),
+				Mode:    uint32(rootInfo.Mode()),
+				IsDir:   false,
+			}
+			if calcHash {
+				hash, err := CalculateHash(root)
+				if err == nil {
+					fi.Hash = hash
+				}
+			}
+			yield(fi, nil)
+			return
 		}
 
-		// We want relative paths in the FileInfo
-		rel, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
-		if rel == "." {
-			return nil
-		}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && utils.IsTempFile(info.Name()) {
+				return nil
+			}
+			if isExcluded(path, root, excludes) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 
-		fi := protocol.FileInfo{
-			Path:    filepath.ToSlash(rel),
-			Size:    info.Size(),
-			ModTime: info.ModTime().Unix(),
-			Mode:    uint32(info.Mode()),
-			IsDir:   info.IsDir(),
-		}
+			// We want relative paths in the FileInfo
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
 
-		if calcHash && !info.IsDir() {
-			hash, err := CalculateHash(path)
-			if err == nil {
-				fi.Hash = hash
+			fi := protocol.FileInfo{
+				Path:    filepath.ToSlash(rel),
+				Size:    info.Size(),
+				ModTime: info.ModTime().Unix(),
+				Mode:    uint32(info.Mode()),
+				IsDir:   info.IsDir(),
 			}
-		}
 
-		files = append(files, fi)
-		return nil
-	})
-	return files, err
+			if calcHash && !info.IsDir() {
+				hash, err := CalculateHash(path)
+				if err == nil {
+					fi.Hash = hash
+				}
+			}
+
+			if !yield(fi, nil) {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			yield(protocol.FileInfo{}, err)
+		}
+	}
 }
 
 func CalculateHash(path string) (string, error) {
@@ -128,3 +154,37 @@ func CalculateHash(path string) (string, error) {
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// ErrHashMismatch means a file doesn't hash to what its sender read.
+// It matches the same error reported by the peer, see protocol.ErrorMsg.Is.
+var ErrHashMismatch error = &protocol.ErrorMsg{
+	Code:      protocol.ErrCodeHashMismatch,
+	Message:   "hash mismatch, the file was corrupted in transit",
+	Retryable: true,
+}
+
+// VerifyHash checks that the file at path hashes to want.
+// An empty want means the sender didn't send a hash.
+func VerifyHash(path, want string) error {
+	if want == "" {
+		return nil
+	}
+	hash, err := CalculateHash(path)
+	if err != nil {
+		return err
+	}
+	if hash != want {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// CalculatePrefixHash hashes the first n bytes of r.
+// It fails if r is shorter than n.
+func CalculatePrefixHash(r io.Reader, n int64) (string, error) {
+	h := md5.New()
+	if _, err := io.CopyN(h, r, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
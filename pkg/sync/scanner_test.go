@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/taurusxin/fastsync/pkg/utils"
+)
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "a/b", "skip"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{
+		"a/b/c.txt", "a.txt", "a/z", "skip/f", "x.log",
+		filepath.Base(utils.TempPath("a/t")), filepath.Base(utils.PartialPath("p")),
+	} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Temporary and partial files are skipped in directories too
+	os.WriteFile(utils.PartialPath(filepath.Join(root, "a/b/c.txt")), nil, 0600)
+
+	var got []string
+	for fi, err := range Walk(root, []string{"skip", "*.log"}, true) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir && fi.Hash != "8d777f385d3dfec8815d20f7496026dc" {
+			t.Errorf("%s hashes to %q", fi.Path, fi.Hash)
+		}
+		got = append(got, fi.Path)
+	}
+	want := []string{"a", "a/b", "a/b/c.txt", "a/z", "a.txt"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("walked %q, want %q", got, want)
+	}
+	if !slices.IsSortedFunc(got, ComparePaths) {
+		t.Fatalf("walk order %q doesn't match ComparePaths", got)
+	}
+}
+
+func TestWalkFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single.bin")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := Scan(path, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "single.bin" || files[0].Size != 4 {
+		t.Fatalf("scanned %+v", files)
+	}
+}
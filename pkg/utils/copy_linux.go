@@ -0,0 +1,37 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reflink makes dst share the data blocks of src with the FICLONE ioctl,
+// so the copy takes no time and no space until either file is modified.
+// Only filesystems like Btrfs and XFS support it.
+func Reflink(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// CopyFileRange copies up to n bytes from the current offset of src to the
+// current offset of dst inside the kernel and advances both. It returns
+// errors.ErrUnsupported if the files can't be copied this way, for example
+// across filesystems on older kernels.
+func CopyFileRange(dst, src *os.File, n int64) (int64, error) {
+	for {
+		written, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(n), 0)
+		switch err {
+		case nil:
+			return int64(written), nil
+		case unix.EINTR:
+			continue
+		case unix.ENOSYS, unix.EXDEV, unix.EINVAL, unix.EOPNOTSUPP, unix.EPERM:
+			return 0, errors.ErrUnsupported
+		default:
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflink is only supported on Linux
+func Reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
+
+// CopyFileRange is only supported on Linux
+func CopyFileRange(dst, src *os.File, n int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -2,8 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func SecureJoin(root, unsafePath string) (string, error) {
@@ -18,6 +22,117 @@ func SecureJoin(root, unsafePath string) (string, error) {
 	return path, nil
 }
 
+const (
+	// TempSuffix marks files that are still being written
+	TempSuffix = ".fastsync-tmp"
+	// PartialSuffix marks interrupted transfers that can be resumed
+	PartialSuffix = ".fastsync-partial"
+	// PartialMaxAge is how long an untouched partial file is kept for resuming
+	PartialMaxAge = 7 * 24 * time.Hour
+)
+
+// TempPath returns a hidden temporary path next to path.
+// Writing there and renaming keeps path intact while the new content is built.
+func TempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+TempSuffix)
+}
+
+// PartialPath returns the hidden path where an incoming transfer of path is written.
+// It's left behind when the transfer is interrupted so the next run can resume it.
+func PartialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+PartialSuffix)
+}
+
+// StalePartial reports whether the partial file of info was left untouched
+// for longer than PartialMaxAge and should be discarded instead of resumed.
+func StalePartial(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > PartialMaxAge
+}
+
+// RemovePath deletes a synced file or an empty directory, together with the
+// temporary and partial files left behind by interrupted transfers. Those
+// belong to files that are gone as well and would keep a directory from
+// being removed.
+func RemovePath(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		os.Remove(PartialPath(path))
+		return os.Remove(path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && IsTempFile(e.Name()) {
+			os.Remove(filepath.Join(path, e.Name()))
+		}
+	}
+	return os.Remove(path)
+}
+
+// OpenPartial opens the partial file for writing.
+// A non-zero offset keeps that many bytes of existing content and appends after them.
+func OpenPartial(path string, offset int64) (*os.File, error) {
+	if offset == 0 {
+		return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() < offset {
+		err = fmt.Errorf("partial file is shorter than resume offset %d", offset)
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// CommitFile flushes f to disk, applies mode and modTime and renames it to path.
+// Readers of path never see a half-written file, and a crash keeps the old copy.
+// A zero mode or modTime is left alone, and a file written in place is not renamed.
+// f is closed in any case and removed if anything fails.
+func CommitFile(f *os.File, path string, mode uint32, modTime int64) error {
+	tmpPath := f.Name()
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && mode > 0 {
+		err = os.Chmod(tmpPath, os.FileMode(mode))
+	}
+	if err == nil && modTime > 0 {
+		err = os.Chtimes(tmpPath, time.Unix(modTime, 0), time.Unix(modTime, 0))
+	}
+	if tmpPath == path {
+		return err
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, TempSuffix) || strings.HasSuffix(name, PartialSuffix))
+}
+
 func FormatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -30,3 +145,22 @@ func FormatBytes(bytes int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
+
+// ParseBytes parses a size such as "512K", "64M" or "1.5GB" into bytes.
+// Units are powers of 1024 like in FormatBytes, a plain number is bytes.
+func ParseBytes(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	mult := 1.0
+	if i := strings.IndexAny(str, "KMGTPE"); i >= 0 && i == len(str)-1 {
+		for range strings.IndexByte("KMGTPE", str[i]) + 1 {
+			mult *= 1024
+		}
+		str = str[:i]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * mult), nil
+}
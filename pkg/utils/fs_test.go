@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemovePathLeftovers(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sub")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "a.txt")
+	for _, p := range []string{file, PartialPath(file), PartialPath(filepath.Join(dir, "gone.bin")), TempPath(filepath.Join(dir, "b"))} {
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemovePath(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(PartialPath(file)); !os.IsNotExist(err) {
+		t.Fatalf("partial of removed file kept: %v", err)
+	}
+	// Only leftovers of interrupted transfers are left in the directory
+	if err := RemovePath(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("directory kept: %v", err)
+	}
+}
+
+func TestRemovePathKeepsContent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemovePath(dir); err == nil {
+		t.Fatal("removed a directory with content")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStalePartial(t *testing.T) {
+	path := PartialPath(filepath.Join(t.TempDir(), "f"))
+	if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	if StalePartial(info) {
+		t.Fatal("new partial is stale")
+	}
+	old := time.Now().Add(-PartialMaxAge - time.Hour)
+	os.Chtimes(path, old, old)
+	info, _ = os.Stat(path)
+	if !StalePartial(info) {
+		t.Fatal("old partial is not stale")
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bandwidth limit is a rate in bytes per second with an optional K/M/G
+// suffix, 0 for unlimited. Time of day windows can set other rates:
+//
+//	1M,08:00-18:00=256K,22:00-06:00=0
+//
+// limits to 256KB/s during office hours, lifts the limit at night and
+// uses 1MB/s otherwise. The first matching window wins.
+
+// rateWindow is a time of day window of a schedule, in minutes since midnight
+type rateWindow struct {
+	from, to int
+	rate     int64
+}
+
+// matches reports whether minute lies in the window, which may wrap past midnight
+func (w rateWindow) matches(minute int) bool {
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+// RateSchedule is a parsed bandwidth limit
+type RateSchedule struct {
+	rate    int64 // Outside of the windows
+	windows []rateWindow
+}
+
+// ParseRateSchedule parses a bandwidth limit like "1M,08:00-18:00=256K"
+func ParseRateSchedule(s string) (RateSchedule, error) {
+	var sched RateSchedule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, rateStr, hasSpan := strings.Cut(part, "=")
+		if !hasSpan {
+			rate, err := ParseBytes(part)
+			if err != nil {
+				return RateSchedule{}, fmt.Errorf("invalid rate %q", part)
+			}
+			sched.rate = rate
+			continue
+		}
+		fromStr, toStr, ok := strings.Cut(span, "-")
+		from, err1 := parseClock(fromStr)
+		to, err2 := parseClock(toStr)
+		if !ok || err1 != nil || err2 != nil {
+			return RateSchedule{}, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", span)
+		}
+		rate, err := ParseBytes(rateStr)
+		if err != nil {
+			return RateSchedule{}, fmt.Errorf("invalid rate %q", rateStr)
+		}
+		sched.windows = append(sched.windows, rateWindow{from, to, rate})
+	}
+	return sched, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Unlimited reports whether the schedule never limits
+func (s RateSchedule) Unlimited() bool {
+	if s.rate > 0 {
+		return false
+	}
+	for _, w := range s.windows {
+		if w.rate > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// At returns the rate at local time now, 0 for unlimited
+func (s RateSchedule) At(now time.Time) int64 {
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range s.windows {
+		if w.matches(minute) {
+			return w.rate
+		}
+	}
+	return s.rate
+}
+
+// RateLimiter is a token bucket shared by all connections it limits.
+// A nil RateLimiter doesn't limit.
+type RateLimiter struct {
+	sched RateSchedule
+
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for the bandwidth limit s,
+// or nil if s never limits
+func NewRateLimiter(s string) (*RateLimiter, error) {
+	sched, err := ParseRateSchedule(s)
+	if err != nil || sched.Unlimited() {
+		return nil, err
+	}
+	return &RateLimiter{sched: sched}, nil
+}
+
+// Wait takes n bytes from the bucket and sleeps until they are covered by
+// the current rate. Waiters may overdraw the bucket, each one then sleeps
+// for its share of the debt.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	rate := l.sched.At(now)
+	if rate <= 0 {
+		l.rate = 0
+		l.mu.Unlock()
+		return
+	}
+	// A quarter of a second of data may be sent in a burst
+	burst := float64(rate) / 4
+	if rate != l.rate {
+		// Start the new rate with a full bucket
+		l.rate = rate
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*float64(rate))
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
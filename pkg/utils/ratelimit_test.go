@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"1K", 1024},
+		{"1k", 1024},
+		{"1KB", 1024},
+		{"1KiB", 1024},
+		{"1.5M", 1536 * 1024},
+		{" 64M ", 64 << 20},
+		{"2G", 2 << 30},
+		{"1T", 1 << 40},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "-1", "1X", "K", "1KK", "1K2"} {
+		if got, err := ParseBytes(in); err == nil {
+			t.Errorf("ParseBytes(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseRateSchedule(t *testing.T) {
+	type check struct {
+		when time.Time
+		want int64
+	}
+	tests := []struct {
+		in        string
+		unlimited bool
+		checks    []check
+	}{
+		{"", true, []check{{at(12, 0), 0}}},
+		{"0", true, []check{{at(12, 0), 0}}},
+		{"1M", false, []check{{at(0, 0), 1 << 20}, {at(23, 59), 1 << 20}}},
+		{"1M,08:00-18:00=256K", false, []check{
+			{at(7, 59), 1 << 20},
+			{at(8, 0), 256 << 10},
+			{at(17, 59), 256 << 10},
+			{at(18, 0), 1 << 20},
+		}},
+		{"1M, 22:00-06:00=0", false, []check{
+			{at(21, 59), 1 << 20},
+			{at(22, 0), 0},
+			{at(3, 0), 0},
+			{at(6, 0), 1 << 20},
+		}},
+		{"08:00-18:00=256K", false, []check{{at(12, 0), 256 << 10}, {at(20, 0), 0}}},
+		{"0,08:00-18:00=0", true, nil},
+		// The first matching window wins
+		{"09:00-12:00=1K,08:00-18:00=2K", false, []check{
+			{at(10, 0), 1 << 10},
+			{at(8, 30), 2 << 10},
+		}},
+	}
+	for _, tt := range tests {
+		sched, err := ParseRateSchedule(tt.in)
+		if err != nil {
+			t.Errorf("ParseRateSchedule(%q): %v", tt.in, err)
+			continue
+		}
+		if sched.Unlimited() != tt.unlimited {
+			t.Errorf("ParseRateSchedule(%q).Unlimited() = %v", tt.in, sched.Unlimited())
+		}
+		for _, c := range tt.checks {
+			if got := sched.At(c.when); got != c.want {
+				t.Errorf("ParseRateSchedule(%q).At(%s) = %d, want %d", tt.in, c.when.Format("15:04"), got, c.want)
+			}
+		}
+	}
+
+	for _, in := range []string{"fast", "1M,08:00=1K", "1M,8-18=1K", "1M,08:00-25:00=1K", "1M,08:00-18:00=lots", "1M,=1K"} {
+		if _, err := ParseRateSchedule(in); err == nil {
+			t.Errorf("ParseRateSchedule(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestNewRateLimiterUnlimited(t *testing.T) {
+	for _, in := range []string{"", "0", "0,08:00-18:00=0"} {
+		l, err := NewRateLimiter(in)
+		if err != nil || l != nil {
+			t.Errorf("NewRateLimiter(%q) = %v, %v, want nil", in, l, err)
+		}
+	}
+	if _, err := NewRateLimiter("fast"); err == nil {
+		t.Error("NewRateLimiter accepted an invalid limit")
+	}
+
+	// A nil limiter doesn't limit
+	var l *RateLimiter
+	start := time.Now()
+	l.Wait(1 << 30)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("nil limiter waited %v", d)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	const rate = 4 << 20
+	l, err := NewRateLimiter("4M")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A quarter of a second of data goes out as a burst
+	start := time.Now()
+	l.Wait(rate / 4)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("burst waited %v", d)
+	}
+
+	// Then the bucket refills at the rate
+	start = time.Now()
+	l.Wait(rate / 4)
+	l.Wait(rate / 4)
+	d := time.Since(start)
+	if d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("half a second of data took %v", d)
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	const rate = 4 << 20
+	l, err := NewRateLimiter("4M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Wait(rate / 4) // Empty the bucket
+
+	// Concurrent waiters share the rate
+	start := time.Now()
+	done := make(chan struct{})
+	for range 4 {
+		go func() {
+			l.Wait(rate / 8)
+			done <- struct{}{}
+		}()
+	}
+	for range 4 {
+		<-done
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("half a second of data from 4 waiters took %v", d)
+	}
+}
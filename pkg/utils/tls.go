@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate as lowercase hex
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint accepts fingerprints in the common notations
+// (optional "SHA256:" prefix, colons, any case) and returns lowercase hex.
+func NormalizeFingerprint(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 7 && strings.EqualFold(s[:7], "sha256:") {
+		s = s[7:]
+	}
+	return strings.ToLower(strings.ReplaceAll(s, ":", ""))
+}
+
+// LoadCertPool reads PEM encoded CA certificates from path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}